@@ -2,138 +2,874 @@ package graphite
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var mutex = &sync.Mutex{}
-
 // Aggregator is an interface exposing the methods that we can use to work with different kinds of metrics
 // in a transparent way for the user.
 type Aggregator interface {
-	AddSum(string, interface{})
-	Increase(string)
-	AddAverage(string, interface{})
-	SetActive(string)
-	SetInactive(string)
+	AddSum(string, interface{}) error
+	AddSumTagged(string, map[string]string, interface{}) error
+	Increase(string) error
+	IncreaseTagged(string, map[string]string) error
+	AddAverage(string, interface{}) error
+	AddAverageTagged(string, map[string]string, interface{}) error
+	SetActive(string) error
+	SetActiveTagged(string, map[string]string) error
+	SetInactive(string) error
+	SetInactiveTagged(string, map[string]string) error
+	SetMin(string, interface{}) error
+	SetMinTagged(string, map[string]string, interface{}) error
+	SetMax(string, interface{}) error
+	SetMaxTagged(string, map[string]string, interface{}) error
+	SetLast(string, interface{}) error
+	SetLastTagged(string, map[string]string, interface{}) error
+	Observe(string, interface{}) error
+	ObserveTagged(string, map[string]string, interface{}) error
+	AddTiming(string, time.Duration) error
+	AddTimingTagged(string, map[string]string, time.Duration) error
+	ObserveSketch(string, interface{}) error
+	ObserveSketchTagged(string, map[string]string, interface{}) error
+	MergeSketch(string, *MetricSketch) error
+	MergeSketchTagged(string, map[string]string, *MetricSketch) error
+	Sketch(string) *MetricSketch
+	SketchTagged(string, map[string]string) *MetricSketch
+	SetGauge(string, interface{}) error
+	SetGaugeTagged(string, map[string]string, interface{}) error
+	IncreaseGauge(string, interface{}) error
+	IncreaseGaugeTagged(string, map[string]string, interface{}) error
+	DecreaseGauge(string, interface{}) error
+	DecreaseGaugeTagged(string, map[string]string, interface{}) error
+	Mark(string, interface{}) error
+	MarkTagged(string, map[string]string, interface{}) error
+	AddUnique(string, string) error
+	AddUniqueTagged(string, map[string]string, string) error
+	Remove(string) error
+	RemoveTagged(string, map[string]string) error
+	Update(string, interface{}, func() Metric) error
+	UpdateTagged(string, map[string]string, interface{}, func() Metric) error
+	WithPrefix(string) Aggregator
+	WithTags(map[string]string) Aggregator
 	Run(time.Duration, chan bool) Aggregator
 	Flush() (int, error)
+	FlushContext(context.Context) (int, error)
 	Retry() (int, error)
+	Stop(context.Context) error
+	Close() error
 }
 
+const (
+	// aggregatorShards is the number of shards the metrics of an aggregator are split in, so
+	// the updates of different paths don't block each other.
+	aggregatorShards = 32
+)
+
+// aggregator stores the metrics and sends them to graphite. The scoped views created with
+// `WithPrefix` and `WithTags` share its state, only adding their prefix and tags to the metrics.
 type aggregator struct {
-	config  *Config
+	*aggregatorState
+	prefix string
+	tags   map[string]string
+}
+
+// aggregatorState is the state shared by an aggregator and its scoped views: the metrics,
+// the client and the periodic flushing.
+type aggregatorState struct {
+	// period and flushed are accessed atomically, first in the struct to be 64-bit aligned.
+	period int64
+	// flushed is the time in nanoseconds of the last flush, when the current interval started.
+	flushed  int64
+	config   *Config
+	shards   []*shard
+	client   Graphite
+	spool    *spool
+	flushing sync.Mutex
+	running  sync.WaitGroup
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// shard stores a subset of the metrics of an aggregator, selected by the hash of their series,
+// with its own lock.
+type shard struct {
+	mutex   sync.Mutex
 	metrics map[string]Metric
-	client  Graphite
+	updated map[string]time.Time
+}
+
+// batch stores the metrics taken from the aggregator to send them to graphite. The retained
+// metrics are kept in the aggregator while they are sent, so they can still be updated.
+type batch struct {
+	buffer   *bytes.Buffer
+	taken    map[string]Metric
+	retained map[string]RetainedMetric
+}
+
+func newAggregator(config *Config, client Graphite) Aggregator {
+	shards := make([]*shard, aggregatorShards)
+	for i := range shards {
+		shards[i] = &shard{metrics: map[string]Metric{}, updated: map[string]time.Time{}}
+	}
+	return &aggregator{
+		aggregatorState: &aggregatorState{
+			config:  config,
+			client:  client,
+			shards:  shards,
+			spool:   newSpool(config),
+			flushed: time.Now().UnixNano(),
+			stopped: make(chan struct{}),
+		},
+	}
 }
 
-// GetMetrics retuns the metrics stored till this point in the aggregator.
+// WithPrefix returns a view of the aggregator adding the prefix to the path of all its metrics,
+// after the namespace of the configuration. The view shares the metrics and the flushing with the
+// aggregator, so each part of an application can use its own subtree of metrics:
+//
+//         handlers := aggregator.WithPrefix("http.handlers")
+//         handlers.Increase("users.requests")
+//
+// The prefixes of the nested views are joined, and flushing or stopping any of them affects the
+// aggregator and all its views.
+func (a *aggregator) WithPrefix(prefix string) Aggregator {
+	return &aggregator{
+		aggregatorState: a.aggregatorState,
+		prefix:          a.getScopedPath(prefix),
+		tags:            a.tags,
+	}
+}
+
+// WithTags returns a view of the aggregator like WithPrefix, adding the tags to all its metrics.
+// The tags of the view take precedence over the default ones of the configuration, and the ones
+// received by each method over the ones of the view.
+//
+//         eu := aggregator.WithTags(map[string]string{"dc": "eu"})
+//         eu.AddSumTagged("http.requests", map[string]string{"code": "200"}, 1)
+func (a *aggregator) WithTags(tags map[string]string) Aggregator {
+	return &aggregator{
+		aggregatorState: a.aggregatorState,
+		prefix:          a.prefix,
+		tags:            mergeTags(a.tags, tags),
+	}
+}
+
+// getScopedPath returns the path with the prefix of the view, if any.
+func (a *aggregator) getScopedPath(path string) string {
+	if a.prefix != "" && path != "" {
+		return a.prefix + pathSeparator + path
+	}
+	return a.prefix + path
+}
+
+// getScopedSeries returns the series identified by the path and the tags within the view.
+func (a *aggregator) getScopedSeries(path string, tags map[string]string) (string, error) {
+	if len(a.tags) > 0 {
+		tags = mergeTags(a.tags, tags)
+	}
+	return a.config.getSeriesPath(a.getScopedPath(path), tags)
+}
+
+// GetMetrics retuns a copy of the metrics stored till this point in the aggregator.
 func (a *aggregator) GetMetrics() map[string]Metric {
-	return a.metrics
+	metrics := map[string]Metric{}
+	for _, shard := range a.shards {
+		shard.mutex.Lock()
+		for series, metric := range shard.metrics {
+			metrics[series] = metric
+		}
+		shard.mutex.Unlock()
+	}
+	return metrics
 }
 
 // Retry tries to retry the flush of metrics in case something went wrong. If this
-// retry went wrong it won't try a third time.
+// retry went wrong it won't try a third time, and the metrics are persisted in the spool
+// if one is configured. If the reconnect policy of the client doesn't allow to reconnect
+// yet, it fails immediately with its error.
 func (a *aggregator) Retry() (int, error) {
-	a.client.Reconnect()
-	return a.Flush()
+	return a.retry(context.Background())
 }
 
-func (a *aggregator) getMetric(path string, defaultMetric Metric) Metric {
-	metricPath := a.config.getMetricPath(path)
-	if metric, exists := a.metrics[metricPath]; exists {
+func (a *aggregator) retry(ctx context.Context) (int, error) {
+	a.flushing.Lock()
+	defer a.flushing.Unlock()
+	batch := a.take()
+	data := append([]byte{}, batch.buffer.Bytes()...)
+	n, err := 0, a.reconnect()
+	if err == nil {
+		if n, err = a.sendData(ctx, data); err == nil {
+			a.commit(batch)
+			return n, nil
+		}
+	}
+	if !batch.isEmpty() {
+		a.persist(batch, data)
+	}
+	return n, err
+}
+
+// reconnect reconnects the client, only returning the errors of the reconnect policy as the
+// client reconnects anyway when sending.
+func (a *aggregator) reconnect() error {
+	if err := a.client.Reconnect(); err != nil && isReconnectPolicyError(err) {
+		return err
+	}
+	return nil
+}
+
+func (a *aggregator) getShard(series string) *shard {
+	hasher := fnv.New32a()
+	hasher.Write([]byte(series))
+	return a.shards[hasher.Sum32()%uint32(len(a.shards))]
+}
+
+func (shard *shard) getMetric(series string, factory func() Metric) Metric {
+	if metric, exists := shard.metrics[series]; exists {
 		return metric
 	}
-	return defaultMetric
+	return factory()
+}
+
+func (shard *shard) setMetric(series string, metric Metric) {
+	shard.metrics[series] = metric
+	shard.updated[series] = time.Now()
+}
+
+func (shard *shard) removeMetric(series string) {
+	delete(shard.metrics, series)
+	delete(shard.updated, series)
+}
+
+// expireMetrics removes the retained metrics that haven't been updated during the ttl. The rest
+// of metrics are never expired, as they are only kept until sent.
+func (shard *shard) expireMetrics(now time.Time, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	for series, updated := range shard.updated {
+		if _, retained := shard.metrics[series].(RetainedMetric); retained && now.Sub(updated) > ttl {
+			shard.removeMetric(series)
+		}
+	}
 }
 
-func (a *aggregator) setMetric(path string, metric Metric) {
-	metricPath := a.config.getMetricPath(path)
-	a.metrics[metricPath] = metric
+// convert converts the durations to the unit of the configuration.
+func (a *aggregator) convert(value interface{}) interface{} {
+	if duration, ok := value.(time.Duration); ok {
+		return toUnit(duration, a.config.getDurationUnit())
+	}
+	return value
 }
 
-func (a *aggregator) updateMetric(path string, value interface{}, defaultMetric Metric) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	metric := a.getMetric(path, defaultMetric)
-	metric.Update(value)
-	a.setMetric(path, metric)
+// updateMetric updates the metric identified by the path and the tags, so the metrics
+// with the same path but different tags are aggregated separately. If the metric doesn't
+// exist yet, it's created with the factory. The durations are converted to the unit of
+// the configuration.
+func (a *aggregator) updateMetric(path string, tags map[string]string, value interface{}, factory func() Metric) error {
+	series, err := a.getScopedSeries(path, tags)
+	if err != nil {
+		return err
+	}
+	value = a.convert(value)
+	shard := a.getShard(series)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	metric := shard.getMetric(series, factory)
+	if metric == nil {
+		return fmt.Errorf("Unable to create the metric for %s", series)
+	}
+	if err := metric.Update(value); err != nil {
+		return err
+	}
+	shard.setMetric(series, metric)
+	return nil
 }
 
-// Flush forces sending the current stored metrics to graphite.
+// take removes the metrics from the aggregator, keeping the retained ones, and writes them in
+// a buffer to send them. The retained metrics not updated during the GaugeTTL of the
+// configuration are discarded.
+func (a *aggregator) take() *batch {
+	now := time.Now()
+	batch := &batch{
+		buffer:   bytes.NewBufferString(""),
+		taken:    map[string]Metric{},
+		retained: map[string]RetainedMetric{},
+	}
+	atomic.StoreInt64(&a.flushed, now.UnixNano())
+	for _, shard := range a.shards {
+		shard.mutex.Lock()
+		shard.expireMetrics(now, a.config.GaugeTTL)
+		for series, metric := range shard.metrics {
+			writeMetric(batch.buffer, series, metric, a.getTimestamp(series, now))
+			if retained, ok := metric.(RetainedMetric); ok {
+				batch.retained[series] = retained
+				continue
+			}
+			batch.taken[series] = metric
+			shard.removeMetric(series)
+		}
+		shard.mutex.Unlock()
+	}
+	return batch
+}
+
+// getTimestamp returns the timestamp of the series for a flush at the time received, aligned
+// to the interval of the storage schema matching it, the configuration or the period used
+// to flush, in that order.
+func (a *aggregator) getTimestamp(series string, now time.Time) int64 {
+	if a.config.Alignment == AlignmentNone {
+		return now.Unix()
+	}
+	interval, ok := a.config.StorageSchemas.getPrecision(series)
+	if !ok {
+		interval = a.config.AlignmentInterval
+	}
+	if interval <= 0 {
+		interval = time.Duration(atomic.LoadInt64(&a.period))
+	}
+	return align(now, interval, a.config.Alignment)
+}
+
+// commit confirms the retained metrics of the batch have been sent, committing their values
+// if they are a CommittedMetric and removing the ones that don't have to be retained anymore.
+func (a *aggregator) commit(batch *batch) {
+	for series, metric := range batch.retained {
+		shard := a.getShard(series)
+		shard.mutex.Lock()
+		if current, exists := shard.metrics[series]; exists && current == metric {
+			if committed, ok := metric.(CommittedMetric); ok {
+				committed.Commit()
+			}
+			if !metric.Retain() {
+				shard.removeMetric(series)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+}
+
+// restore returns to the aggregator the metrics of a batch that couldn't be sent. If a metric
+// has been updated meanwhile, the newer one is kept, merging the values of the batch into it
+// if it's a MergeableMetric.
+func (a *aggregator) restore(batch *batch) {
+	for series, metric := range batch.taken {
+		shard := a.getShard(series)
+		shard.mutex.Lock()
+		if current, exists := shard.metrics[series]; !exists {
+			shard.setMetric(series, metric)
+		} else if mergeable, ok := current.(MergeableMetric); ok {
+			if err := mergeable.Merge(metric); err != nil {
+				log.Printf("Unable to restore the metric %s: %s\n", series, err.Error())
+			}
+		}
+		shard.mutex.Unlock()
+	}
+}
+
+func (batch *batch) isEmpty() bool {
+	return len(batch.taken) == 0 && len(batch.retained) == 0
+}
+
+// Flush forces sending the current stored metrics to graphite. If a spool is configured, the metrics
+// persisted previously in it are replayed first, so graphite receives all the metrics in order. If
+// they can't be replayed, the current metrics are kept in the aggregator without sending them.
 func (a *aggregator) Flush() (int, error) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	if len(a.metrics) > 0 {
-		buffer := bytes.NewBufferString("")
-		timestamp := time.Now().Unix()
-		for path, metric := range a.metrics {
-			buffer.WriteString(fmt.Sprintf("%s %s %d\n", path, metric.Calculate(), timestamp))
+	return a.FlushContext(context.Background())
+}
+
+// FlushContext forces sending the current stored metrics to graphite like Flush, but connecting
+// and writing are aborted if the context is cancelled or its deadline is exceeded. The metrics
+// are taken from the aggregator before sending them, so it can keep being updated meanwhile, and
+// they are restored if they can't be sent.
+func (a *aggregator) FlushContext(ctx context.Context) (int, error) {
+	a.flushing.Lock()
+	defer a.flushing.Unlock()
+	n, err := a.replay(ctx)
+	if err != nil {
+		return n, err
+	}
+	batch := a.take()
+	if batch.isEmpty() {
+		return n, nil
+	}
+	sent, err := a.client.SendBufferContext(ctx, batch.buffer)
+	n += sent
+	if err != nil {
+		a.restore(batch)
+		return n, err
+	}
+	a.commit(batch)
+	return n, nil
+}
+
+// replay sends the metrics persisted in the spool, if any.
+func (a *aggregator) replay(ctx context.Context) (int, error) {
+	if a.spool == nil {
+		return 0, nil
+	}
+	n, err := a.spool.replay(ctx, a.client)
+	if err != nil {
+		return n, fmt.Errorf("Unable to replay the spooled metrics: %s", err.Error())
+	}
+	return n, nil
+}
+
+func writeMetric(buffer *bytes.Buffer, series string, metric Metric, timestamp int64) {
+	if multi, ok := metric.(MultiMetric); ok {
+		name, tags := parseSeries(series)
+		for suffix, value := range multi.CalculateAll() {
+			buffer.WriteString(format(formatSeries(name+"."+suffix, tags), value, timestamp))
 		}
-		n, err := a.client.SendBuffer(buffer)
-		if err == nil {
-			a.metrics = map[string]Metric{}
+		return
+	}
+	buffer.WriteString(format(series, metric.Calculate(), timestamp))
+}
+
+// persist writes the metrics of the batch in the spool exactly as they were sent, with their
+// original timestamps, so they are not lost if they can't be sent before the process exits. If
+// there is no spool or they can't be written, the metrics are restored in the aggregator.
+func (a *aggregator) persist(batch *batch, data []byte) {
+	if a.spool == nil {
+		a.restore(batch)
+		return
+	}
+	if err := a.spool.write(data); err != nil {
+		log.Printf("Unable to persist metrics in the spool: %s\n", err.Error())
+		a.restore(batch)
+		return
+	}
+	a.commit(batch)
+}
+
+func (a *aggregator) tick() {
+	a.send(context.Background())
+}
+
+// send flushes the metrics like FlushContext, reconnecting and sending exactly the same lines once
+// more if something went wrong, and persists them in the spool if they couldn't be sent neither,
+// returning the error.
+func (a *aggregator) send(ctx context.Context) error {
+	a.flushing.Lock()
+	defer a.flushing.Unlock()
+	batch := a.take()
+	data := append([]byte{}, batch.buffer.Bytes()...)
+	_, err := a.sendData(ctx, data)
+	if err == nil {
+		a.commit(batch)
+		return nil
+	}
+	log.Printf("Unable to send metrics: %s\n", err.Error())
+	if err = a.reconnect(); err == nil {
+		if _, err = a.sendData(ctx, data); err == nil {
+			a.commit(batch)
+			return nil
 		}
+	}
+	log.Printf("Unable to send metrics after reconnecting neither: %s\n", err.Error())
+	if !batch.isEmpty() {
+		a.persist(batch, data)
+	}
+	return err
+}
+
+// sendData replays the spool and then sends the data, if any.
+func (a *aggregator) sendData(ctx context.Context, data []byte) (int, error) {
+	n, err := a.replay(ctx)
+	if err != nil || len(data) == 0 {
 		return n, err
 	}
-	return 0, nil
+	sent, err := a.client.SendBufferContext(ctx, bytes.NewBuffer(data))
+	return n + sent, err
 }
 
 func (a *aggregator) run(period time.Duration, stopSendingMetrics chan bool) {
+	defer a.running.Done()
 	ticker := time.NewTicker(period)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			if _, err := a.Flush(); err != nil {
-				log.Printf("Unable to send metrics: %s\n", err.Error())
-				if _, err := a.Retry(); err != nil {
-					log.Printf("Unable to send metrics after reconnecting neither: %s\n", err.Error())
-				}
-			}
+			a.tick()
 		case <-stopSendingMetrics:
 			return
+		case <-a.stopped:
+			return
 		}
 	}
 }
 
 // AddSum initialises a metric where the final value sent to graphite will be the addition
 // of all the values passed to the aggregator. So if we call `AddSum` with a specific metric path and
-// values 5, 10, 15 and then we `Flush`, we will be sending a final value of 30 to graphite.
-func (a *aggregator) AddSum(path string, value interface{}) {
-	a.updateMetric(path, value, &MetricSum{})
+// values 5, 10, 15 and then we `Flush`, we will be sending a final value of 30 to graphite. The values
+// can be of any numeric type or durations, and an error is returned if the type is not supported.
+func (a *aggregator) AddSum(path string, value interface{}) error {
+	return a.updateMetric(path, nil, value, a.newSum)
+}
+
+// AddSumTagged works like `AddSum` for the series identified by the path and the tags.
+func (a *aggregator) AddSumTagged(path string, tags map[string]string, value interface{}) error {
+	return a.updateMetric(path, tags, value, a.newSum)
 }
 
 // Increase is used as an alias of `AddSum` where the value incremented is always 1. Useful for giving
 // a comprehensive behaviour to the metric.
-func (a *aggregator) Increase(path string) {
-	a.updateMetric(path, 1, &MetricSum{})
+func (a *aggregator) Increase(path string) error {
+	return a.updateMetric(path, nil, 1, a.newSum)
+}
+
+// IncreaseTagged works like `Increase` for the series identified by the path and the tags.
+func (a *aggregator) IncreaseTagged(path string, tags map[string]string) error {
+	return a.updateMetric(path, tags, 1, a.newSum)
 }
 
 // AddAverage initialises a metric where the final value sent to graphite will be the average
 // of all the values passed to the aggregator. So if we call `AddAverage` with a specific metric path
 // and values 2, 10, 10 and then we `Flush`, we will be sending a final value of 7.333333 to graphite. The
 // maximum decimals allowed is 6.
-func (a *aggregator) AddAverage(path string, value interface{}) {
-	a.updateMetric(path, value, &MetricAverage{})
+func (a *aggregator) AddAverage(path string, value interface{}) error {
+	return a.updateMetric(path, nil, value, a.newAverage)
+}
+
+// AddAverageTagged works like `AddAverage` for the series identified by the path and the tags.
+func (a *aggregator) AddAverageTagged(path string, tags map[string]string, value interface{}) error {
+	return a.updateMetric(path, tags, value, a.newAverage)
 }
 
 // SetActive initialises a boolean metric where the final value sent to graphite will
-// be 1, representing an `active` status.
-func (a *aggregator) SetActive(path string) {
-	a.updateMetric(path, true, &MetricActive{})
+// be 1, representing an `active` status. The status is sent on every flush until it's removed.
+func (a *aggregator) SetActive(path string) error {
+	return a.updateMetric(path, nil, true, a.newActive)
+}
+
+// SetActiveTagged works like `SetActive` for the series identified by the path and the tags.
+func (a *aggregator) SetActiveTagged(path string, tags map[string]string) error {
+	return a.updateMetric(path, tags, true, a.newActive)
 }
 
 // SetInactive initialises a boolean metric where the final value sent to graphite will
 // be 0, representing an `inactive` status. It's inteded to be used with
-func (a *aggregator) SetInactive(path string) {
-	a.updateMetric(path, false, &MetricActive{})
+func (a *aggregator) SetInactive(path string) error {
+	return a.updateMetric(path, nil, false, a.newActive)
+}
+
+// SetInactiveTagged works like `SetInactive` for the series identified by the path and the tags.
+func (a *aggregator) SetInactiveTagged(path string, tags map[string]string) error {
+	return a.updateMetric(path, tags, false, a.newActive)
+}
+
+// SetMin initialises a metric where the final value sent to graphite will be the minimum of all
+// the values passed to the aggregator. So if we call `SetMin` with a specific metric path and
+// values 5, 2, 10 and then we `Flush`, we will be sending a final value of 2 to graphite.
+func (a *aggregator) SetMin(path string, value interface{}) error {
+	return a.updateMetric(path, nil, value, a.newMin)
+}
+
+// SetMinTagged works like `SetMin` for the series identified by the path and the tags.
+func (a *aggregator) SetMinTagged(path string, tags map[string]string, value interface{}) error {
+	return a.updateMetric(path, tags, value, a.newMin)
+}
+
+// SetMax initialises a metric where the final value sent to graphite will be the maximum of all
+// the values passed to the aggregator. So if we call `SetMax` with a specific metric path and
+// values 5, 2, 10 and then we `Flush`, we will be sending a final value of 10 to graphite.
+func (a *aggregator) SetMax(path string, value interface{}) error {
+	return a.updateMetric(path, nil, value, a.newMax)
+}
+
+// SetMaxTagged works like `SetMax` for the series identified by the path and the tags.
+func (a *aggregator) SetMaxTagged(path string, tags map[string]string, value interface{}) error {
+	return a.updateMetric(path, tags, value, a.newMax)
+}
+
+// SetLast initialises a metric where the final value sent to graphite will be the latest value
+// passed to the aggregator. So if we call `SetLast` with a specific metric path and values 5, 2,
+// 10 and then we `Flush`, we will be sending a final value of 10 to graphite.
+func (a *aggregator) SetLast(path string, value interface{}) error {
+	return a.updateMetric(path, nil, value, a.newLast)
+}
+
+// SetLastTagged works like `SetLast` for the series identified by the path and the tags.
+func (a *aggregator) SetLastTagged(path string, tags map[string]string, value interface{}) error {
+	return a.updateMetric(path, tags, value, a.newLast)
+}
+
+// Observe initialises a histogram metric where the values passed to the aggregator are sent to
+// graphite as their statistics, each one of them appending its suffix to the metric path: `count`,
+// `min`, `max`, `mean`, `median`, `p90`, `p99` and `stddev`.
+func (a *aggregator) Observe(path string, value interface{}) error {
+	return a.updateMetric(path, nil, value, a.newHistogram)
+}
+
+// ObserveTagged works like `Observe` for the series identified by the path and the tags.
+func (a *aggregator) ObserveTagged(path string, tags map[string]string, value interface{}) error {
+	return a.updateMetric(path, tags, value, a.newHistogram)
+}
+
+// AddTiming works like `Observe` for durations, which are sent to graphite in the `DurationUnit`
+// of the configuration, milliseconds by default.
+func (a *aggregator) AddTiming(path string, duration time.Duration) error {
+	return a.updateMetric(path, nil, duration, a.newHistogram)
+}
+
+// AddTimingTagged works like `AddTiming` for the series identified by the path and the tags.
+func (a *aggregator) AddTimingTagged(path string, tags map[string]string, duration time.Duration) error {
+	return a.updateMetric(path, tags, duration, a.newHistogram)
+}
+
+// ObserveSketch works like `Observe` but using a sketch metric, which uses a bounded amount of
+// memory regardless of the number of values observed, at the cost of calculating the percentiles
+// with the relative accuracy configured in `SketchAccuracy`. The standard deviation is not sent.
+func (a *aggregator) ObserveSketch(path string, value interface{}) error {
+	return a.updateMetric(path, nil, value, a.newSketch)
+}
+
+// ObserveSketchTagged works like `ObserveSketch` for the series identified by the path and the tags.
+func (a *aggregator) ObserveSketchTagged(path string, tags map[string]string, value interface{}) error {
+	return a.updateMetric(path, tags, value, a.newSketch)
+}
+
+// MergeSketch merges a sketch filled somewhere else, like another aggregator, into the sketch
+// metric of the path, so the percentiles are calculated for all the values of both of them.
+func (a *aggregator) MergeSketch(path string, sketch *MetricSketch) error {
+	return a.updateMetric(path, nil, sketch, a.newSketch)
+}
+
+// MergeSketchTagged works like `MergeSketch` for the series identified by the path and the tags.
+func (a *aggregator) MergeSketchTagged(path string, tags map[string]string, sketch *MetricSketch) error {
+	return a.updateMetric(path, tags, sketch, a.newSketch)
+}
+
+// Sketch returns a copy of the sketch metric of the path, or nil if there is no sketch for it. It's
+// intended to combine the sketches of several aggregators, merging them into another one:
+//
+//         for _, worker := range workers {
+//             if sketch := worker.Sketch("request.duration"); sketch != nil {
+//                 global.MergeSketch("request.duration", sketch)
+//             }
+//         }
+//
+// The sketch is still sent by the aggregator it belongs to when flushing, unless the aggregator is
+// only used to fill it, without flushing it.
+func (a *aggregator) Sketch(path string) *MetricSketch {
+	return a.SketchTagged(path, nil)
+}
+
+// SketchTagged works like `Sketch` for the series identified by the path and the tags.
+func (a *aggregator) SketchTagged(path string, tags map[string]string) *MetricSketch {
+	series, err := a.getScopedSeries(path, tags)
+	if err != nil {
+		return nil
+	}
+	shard := a.getShard(series)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if sketch, ok := shard.metrics[series].(*MetricSketch); ok {
+		return sketch.clone()
+	}
+	return nil
+}
+
+// SetGauge initialises a gauge metric where the final value sent to graphite will be the latest
+// value passed to the aggregator. Unlike the rest of metrics, the gauges are sent on every flush
+// until they are removed with `Remove`, or until they aren't updated during the `GaugeTTL` of
+// the configuration.
+func (a *aggregator) SetGauge(path string, value interface{}) error {
+	return a.updateMetric(path, nil, value, a.newGauge)
+}
+
+// SetGaugeTagged works like `SetGauge` for the series identified by the path and the tags.
+func (a *aggregator) SetGaugeTagged(path string, tags map[string]string, value interface{}) error {
+	return a.updateMetric(path, tags, value, a.newGauge)
+}
+
+// IncreaseGauge increases the value of a gauge metric with the amount passed to the aggregator,
+// initialising it to zero if it doesn't exist.
+func (a *aggregator) IncreaseGauge(path string, value interface{}) error {
+	return a.updateGauge(path, nil, value, 1)
+}
+
+// IncreaseGaugeTagged works like `IncreaseGauge` for the series identified by the path and the tags.
+func (a *aggregator) IncreaseGaugeTagged(path string, tags map[string]string, value interface{}) error {
+	return a.updateGauge(path, tags, value, 1)
+}
+
+// DecreaseGauge decreases the value of a gauge metric with the amount passed to the aggregator,
+// initialising it to zero if it doesn't exist.
+func (a *aggregator) DecreaseGauge(path string, value interface{}) error {
+	return a.updateGauge(path, nil, value, -1)
+}
+
+// DecreaseGaugeTagged works like `DecreaseGauge` for the series identified by the path and the tags.
+func (a *aggregator) DecreaseGaugeTagged(path string, tags map[string]string, value interface{}) error {
+	return a.updateGauge(path, tags, value, -1)
+}
+
+func (a *aggregator) updateGauge(path string, tags map[string]string, value interface{}, sign float64) error {
+	number, err := toFloat64(a.convert(value))
+	if err != nil {
+		return err
+	}
+	return a.updateMetric(path, tags, gaugeDelta(sign*number), a.newGauge)
+}
+
+// Mark initialises a meter metric to measure the rate per second of the events passed to the
+// aggregator, sending on each flush the total count, the rate since the previous flush and the
+// 1, 5 and 15 minutes moving averages, appending to the metric path the suffixes `count`, `rate`,
+// `m1_rate`, `m5_rate` and `m15_rate`. The rates don't depend on the period used to flush, as the
+// first interval of a meter starts at the previous flush, and the meters are sent on every flush
+// until they are removed, like the gauges.
+func (a *aggregator) Mark(path string, value interface{}) error {
+	return a.updateMetric(path, nil, value, a.newMeter)
+}
+
+// MarkTagged works like `Mark` for the series identified by the path and the tags.
+func (a *aggregator) MarkTagged(path string, tags map[string]string, value interface{}) error {
+	return a.updateMetric(path, tags, value, a.newMeter)
+}
+
+// AddUnique initialises a metric where the final value sent to graphite will be the approximate
+// number of distinct values passed to the aggregator between flushes, like unique users. The values
+// are not stored, so the memory used doesn't depend on their number.
+func (a *aggregator) AddUnique(path string, value string) error {
+	return a.updateMetric(path, nil, value, a.newUnique)
+}
+
+// AddUniqueTagged works like `AddUnique` for the series identified by the path and the tags.
+func (a *aggregator) AddUniqueTagged(path string, tags map[string]string, value string) error {
+	return a.updateMetric(path, tags, value, a.newUnique)
+}
+
+// Update updates the metric of the path with the value received, creating it with the factory if it
+// doesn't exist yet. It's intended to be used with custom implementations of the `Metric` interface,
+// which get the same namespacing, locking and flushing as the built-in ones:
+//
+//         aggregator.Update("requests.ratio", 0.5, func() graphite.Metric {
+//             return &MyCustomMetric{}
+//         })
+//
+// The factory is only called when the metric doesn't exist, so the type of an existing metric
+// is not changed. Custom metrics can implement `MultiMetric` to send several values, or
+// `RetainedMetric` to be sent on every flush.
+func (a *aggregator) Update(path string, value interface{}, factory func() Metric) error {
+	return a.updateMetric(path, nil, value, factory)
+}
+
+// UpdateTagged works like `Update` for the series identified by the path and the tags.
+func (a *aggregator) UpdateTagged(path string, tags map[string]string, value interface{}, factory func() Metric) error {
+	return a.updateMetric(path, tags, value, factory)
+}
+
+// Remove removes the metric of the path, so it's not sent to graphite anymore. It's intended to be
+// used with the metrics sent on every flush, like gauges or active/inactive statuses.
+func (a *aggregator) Remove(path string) error {
+	return a.RemoveTagged(path, nil)
+}
+
+// RemoveTagged works like `Remove` for the series identified by the path and the tags.
+func (a *aggregator) RemoveTagged(path string, tags map[string]string) error {
+	series, err := a.getScopedSeries(path, tags)
+	if err != nil {
+		return err
+	}
+	shard := a.getShard(series)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	shard.removeMetric(series)
+	return nil
+}
+
+func (a *aggregator) newSum() Metric {
+	return &MetricSum{Precision: a.config.Precision}
+}
+
+func (a *aggregator) newAverage() Metric {
+	return &MetricAverage{Precision: a.config.Precision}
+}
+
+func (a *aggregator) newActive() Metric {
+	return &MetricActive{}
+}
+
+func (a *aggregator) newMin() Metric {
+	return &MetricMin{Precision: a.config.Precision}
+}
+
+func (a *aggregator) newMax() Metric {
+	return &MetricMax{Precision: a.config.Precision}
+}
+
+func (a *aggregator) newLast() Metric {
+	return &MetricLast{Precision: a.config.Precision}
+}
+
+func (a *aggregator) newHistogram() Metric {
+	return &MetricHistogram{Precision: a.config.Precision}
+}
+
+func (a *aggregator) newSketch() Metric {
+	sketch := NewMetricSketch(a.config.SketchAccuracy, a.config.SketchMaxBins)
+	sketch.Precision = a.config.Precision
+	return sketch
+}
+
+func (a *aggregator) newGauge() Metric {
+	return &MetricGauge{Precision: a.config.Precision}
+}
+
+func (a *aggregator) newMeter() Metric {
+	return &MetricMeter{Precision: a.config.Precision, start: time.Unix(0, atomic.LoadInt64(&a.flushed))}
+}
+
+func (a *aggregator) newUnique() Metric {
+	return &MetricUnique{Bits: a.config.UniqueBits}
 }
 
 // Run starts a go routine to periodically flush the values stored in the aggregator to graphite.
 // Useful if we don't want to manually call `Flush` every time.
 func (a *aggregator) Run(period time.Duration, stopSendingMetrics chan bool) Aggregator {
+	a.running.Add(1)
+	atomic.StoreInt64(&a.period, int64(period))
 	go a.run(period, stopSendingMetrics)
 	return a
 }
+
+// Stop stops the periodic flushing started with `Run`, waiting for the flush in progress if any,
+// and then flushes the metrics stored in the aggregator for the last time, retrying once if
+// something went wrong, so they are not lost when the process exits. If they can't be sent, they
+// are persisted in the spool if configured, and the error is returned. If the context is done
+// before finishing, its error is returned.
+//
+//         ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+//         defer cancel()
+//         if err := aggregator.Stop(ctx); err != nil {
+//             log.Printf("Unable to send the last metrics: %s", err.Error())
+//         }
+//
+// The metrics updated after stopping are only sent if `Flush` or `Stop` are called again.
+func (a *aggregator) Stop(ctx context.Context) error {
+	a.stopOnce.Do(func() {
+		close(a.stopped)
+	})
+	finished := make(chan struct{})
+	go func() {
+		a.running.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return a.send(ctx)
+}
+
+// Close stops the aggregator like `Stop`, without any deadline.
+func (a *aggregator) Close() error {
+	return a.Stop(context.Background())
+}
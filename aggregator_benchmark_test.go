@@ -0,0 +1,83 @@
+package graphite
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newBenchmarkAggregator(delay time.Duration) *aggregator {
+	return newAggregator(&Config{}, &MockGraphite{
+		MethodSendBuffer: func(m *MockGraphite, buffer *bytes.Buffer) (int, error) {
+			time.Sleep(delay)
+			return buffer.Len(), nil
+		},
+	}).(*aggregator)
+}
+
+// BenchmarkAggregatorSamePath measures the updates of a single hot path from parallel goroutines.
+func BenchmarkAggregatorSamePath(b *testing.B) {
+	agg := newBenchmarkAggregator(0)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			agg.Increase("requests")
+		}
+	})
+}
+
+// BenchmarkAggregatorManyPaths measures the updates of different paths from parallel goroutines,
+// which are spread across the shards of the aggregator.
+func BenchmarkAggregatorManyPaths(b *testing.B) {
+	agg := newBenchmarkAggregator(0)
+	paths := make([]string, 1000)
+	for i := range paths {
+		paths[i] = "requests." + strconv.Itoa(i)
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			agg.Increase(paths[i%len(paths)])
+			i++
+		}
+	})
+}
+
+// BenchmarkAggregatorSlowFlush measures the updates from parallel goroutines while the aggregator
+// is continuously flushing to a slow graphite, which mustn't block them.
+func BenchmarkAggregatorSlowFlush(b *testing.B) {
+	agg := newBenchmarkAggregator(10 * time.Millisecond)
+	stop := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				agg.Flush()
+			}
+		}
+	}()
+	defer close(stop)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			agg.AddSum("bytes."+strconv.Itoa(i%100), i)
+			i++
+		}
+	})
+}
+
+// BenchmarkAggregatorsParallel measures the updates of independent aggregators from parallel
+// goroutines, which don't share any lock.
+func BenchmarkAggregatorsParallel(b *testing.B) {
+	aggregators := []*aggregator{newBenchmarkAggregator(0), newBenchmarkAggregator(0)}
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			aggregators[i%2].Increase("requests")
+			i++
+		}
+	})
+}
@@ -2,9 +2,11 @@ package graphite
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -67,11 +69,7 @@ var _ = Describe("graphite aggregator", func() {
 				return 0, nil
 			},
 		}
-		agg = &aggregator{
-			config:  &Config{},
-			client:  client,
-			metrics: map[string]Metric{},
-		}
+		agg = newAggregator(&Config{}, client)
 	})
 
 	It("should implement Aggregator interface", func() {
@@ -176,6 +174,138 @@ var _ = Describe("graphite aggregator", func() {
 		})
 	})
 
+	Context("typed values", func() {
+
+		It("returns an error for unsupported types without storing the metric", func() {
+			Expect(agg.AddSum(testMetric, "5")).To(HaveOccurred())
+			Expect(agg.AddAverageTagged(testMetric, map[string]string{"host": "web1"}, nil)).To(HaveOccurred())
+			Expect(agg.(*aggregator).GetMetrics()).To(BeEmpty())
+		})
+
+		It("converts the durations to the unit of the configuration", func() {
+			agg.(*aggregator).config.DurationUnit = time.Second
+			Expect(agg.AddSum(testMetric, 1500*time.Millisecond)).To(Succeed())
+			agg.AddTiming(failMetric, 250*time.Millisecond)
+			metrics := agg.(*aggregator).GetMetrics()
+			Expect(metrics[testMetric].Calculate()).To(Equal("1.500000"))
+			Expect(metrics[failMetric].(*MetricHistogram).Values).To(Equal([]float64{0.25}))
+		})
+
+		It("uses the precision of the configuration", func() {
+			agg.(*aggregator).config.Precision = 3
+			agg.AddAverage(testMetric, 1)
+			agg.AddAverage(testMetric, uint64(2))
+			agg.AddAverage(testMetric, float32(2))
+			Expect(agg.(*aggregator).GetMetrics()[testMetric].Calculate()).To(Equal("1.667"))
+		})
+	})
+
+	Context("tagged aggregates", func() {
+
+		It("aggregates separately the series with different tags", func() {
+			agg.AddSumTagged(testMetric, map[string]string{"host": "web1"}, 5)
+			agg.AddSumTagged(testMetric, map[string]string{"host": "web2"}, 3)
+			agg.IncreaseTagged(testMetric, map[string]string{"host": "web1"})
+			metrics := agg.(*aggregator).GetMetrics()
+			Expect(metrics).To(HaveLen(2))
+			Expect(metrics[testMetric+";host=web1"].Calculate()).To(Equal("6"))
+			Expect(metrics[testMetric+";host=web2"].Calculate()).To(Equal("3"))
+		})
+
+		It("aggregates together the same series regardless of the order of the tags", func() {
+			agg.AddAverageTagged(testMetric, map[string]string{"host": "web1", "dc": "eu"}, 2)
+			agg.AddAverage(testMetric+";host=web1;dc=eu", 4)
+			metrics := agg.(*aggregator).GetMetrics()
+			Expect(metrics).To(HaveLen(1))
+			Expect(metrics[testMetric+";dc=eu;host=web1"].Calculate()).To(Equal("3.000000"))
+		})
+
+		It("adds the default tags of the configuration", func() {
+			agg.(*aggregator).config.Tags = map[string]string{"dc": "eu"}
+			agg.SetActiveTagged(testMetric, map[string]string{"host": "web1"})
+			agg.SetInactiveTagged(testMetric, map[string]string{"host": "web2"})
+			metrics := agg.(*aggregator).GetMetrics()
+			Expect(metrics[testMetric+";dc=eu;host=web1"].Calculate()).To(Equal("1"))
+			Expect(metrics[testMetric+";dc=eu;host=web2"].Calculate()).To(Equal("0"))
+		})
+	})
+
+	Context("sanitized paths", func() {
+
+		It("aggregates together the paths that are the same once sanitized", func() {
+			agg.(*aggregator).config.Sanitize = SanitizeReplace
+			agg.AddSum("requests..count", 2)
+			agg.AddSum("requests.count.", 3)
+			metrics := agg.(*aggregator).GetMetrics()
+			Expect(metrics).To(HaveLen(1))
+			Expect(metrics["requests.count"].Calculate()).To(Equal("5"))
+		})
+
+		It("returns an error without storing the metric if the path is rejected", func() {
+			agg.(*aggregator).config.Sanitize = SanitizeReject
+			Expect(agg.AddSum("requests count", 2)).To(HaveOccurred())
+			Expect(agg.(*aggregator).GetMetrics()).To(BeEmpty())
+		})
+
+		It("returns an error from the methods without a value if the path is rejected", func() {
+			agg.(*aggregator).config.Sanitize = SanitizeReject
+			Expect(agg.Increase("requests count")).To(HaveOccurred())
+			Expect(agg.SetActiveTagged("requests count", map[string]string{"host": "web1"})).To(HaveOccurred())
+			Expect(agg.AddUnique("requests count", "user1")).To(HaveOccurred())
+			Expect(agg.Remove("requests count")).To(HaveOccurred())
+			Expect(agg.(*aggregator).GetMetrics()).To(BeEmpty())
+		})
+	})
+
+	Context("min/max/last aggregates", func() {
+
+		It("should calculate the extremes and the latest value between flushes", func() {
+			for _, value := range []int{5, 2, 10, 7} {
+				agg.SetMin(testMetric+".min", value)
+				agg.SetMax(testMetric+".max", value)
+				agg.SetLastTagged(testMetric+".last", map[string]string{"host": "web1"}, value)
+			}
+			metrics := agg.(*aggregator).GetMetrics()
+			Expect(metrics[testMetric+".min"].Calculate()).To(Equal("2"))
+			Expect(metrics[testMetric+".max"].Calculate()).To(Equal("10"))
+			Expect(metrics[testMetric+".last;host=web1"].Calculate()).To(Equal("7"))
+			agg.Flush()
+			Expect(agg.(*aggregator).GetMetrics()).To(BeEmpty())
+		})
+
+		It("uses the namespace of the configuration", func() {
+			agg.(*aggregator).config.Namespace = "beta"
+			agg.SetMax(testMetric, 5)
+			Expect(agg.(*aggregator).GetMetrics()).To(HaveKey("beta." + testMetric))
+		})
+	})
+
+	Context("histogram aggregates", func() {
+
+		It("should keep all the values observed", func() {
+			agg.Observe(testMetric, 5)
+			agg.Observe(testMetric, 2.5)
+			metrics := agg.(*aggregator).GetMetrics()
+			Expect(metrics[testMetric].(*MetricHistogram).Values).To(Equal([]float64{5, 2.5}))
+		})
+
+		It("should store the timings in milliseconds", func() {
+			agg.AddTiming(testMetric, 1500*time.Microsecond)
+			agg.AddTiming(testMetric, time.Second)
+			metrics := agg.(*aggregator).GetMetrics()
+			Expect(metrics[testMetric].(*MetricHistogram).Values).To(Equal([]float64{1.5, 1000}))
+		})
+
+		It("should send a line for each statistic, appending the suffix before the tags", func() {
+			agg.AddTimingTagged(testMetric, map[string]string{"host": "web1"}, 10*time.Millisecond)
+			buffer := agg.(*aggregator).take().buffer.String()
+			for _, suffix := range []string{"count", "min", "max", "mean", "median", "p90", "p99", "stddev"} {
+				Expect(buffer).To(MatchRegexp(`(?m)^%s\.%s;host=web1 [\d.]+ \d{10}$`, testMetric, suffix))
+			}
+			Expect(strings.Count(buffer, "\n")).To(Equal(8))
+		})
+	})
+
 	Context("active/inactive aggregates", func() {
 
 		It("should set metric to active", func() {
@@ -216,6 +346,143 @@ var _ = Describe("graphite aggregator", func() {
 		})
 	})
 
+	Context("gauge aggregates", func() {
+
+		It("should set, increase and decrease the gauge", func() {
+			agg.IncreaseGauge(testMetric, 5)
+			agg.DecreaseGauge(testMetric, 2)
+			Expect(agg.(*aggregator).GetMetrics()[testMetric].Calculate()).To(Equal("3"))
+			agg.SetGauge(testMetric, 10)
+			Expect(agg.(*aggregator).GetMetrics()[testMetric].Calculate()).To(Equal("10"))
+		})
+
+		It("should keep sending the gauges and statuses on every flush", func() {
+			agg.SetGauge(testMetric, 7)
+			agg.SetActiveTagged(testMetric, map[string]string{"host": "web1"})
+			agg.AddSum(failMetric+".sum", 1)
+			agg.Flush()
+			Expect(agg.(*aggregator).GetMetrics()).To(HaveLen(2))
+			agg.Flush()
+			Expect(getFlushSent(client)).To(Equal(2))
+			Expect(agg.(*aggregator).GetMetrics()).To(HaveKey(testMetric))
+			Expect(agg.(*aggregator).GetMetrics()).To(HaveKey(testMetric + ";host=web1"))
+		})
+
+		It("should stop sending the gauges once removed", func() {
+			agg.SetGaugeTagged(testMetric, map[string]string{"host": "web1"}, 7)
+			agg.RemoveTagged(testMetric, map[string]string{"host": "web1"})
+			Expect(agg.(*aggregator).GetMetrics()).To(BeEmpty())
+		})
+
+		It("should discard the gauges not updated during the ttl", func() {
+			agg.(*aggregator).config.GaugeTTL = time.Minute
+			agg.SetGauge(testMetric, 7)
+			agg.SetGauge(testMetric+".recent", 3)
+			agg.(*aggregator).getShard(testMetric).updated[testMetric] = time.Now().Add(-2 * time.Minute)
+			agg.Flush()
+			Expect(agg.(*aggregator).GetMetrics()).To(HaveLen(1))
+			Expect(agg.(*aggregator).GetMetrics()).To(HaveKey(testMetric + ".recent"))
+		})
+
+		It("should not discard the metrics not retained, even if they weren't updated during the ttl", func() {
+			agg.(*aggregator).config.GaugeTTL = time.Minute
+			agg.AddSum(testMetric, 7)
+			agg.(*aggregator).getShard(testMetric).updated[testMetric] = time.Now().Add(-2 * time.Minute)
+			Expect(agg.(*aggregator).take().taken).To(HaveKey(testMetric))
+		})
+	})
+
+	Context("meter aggregates", func() {
+
+		It("should send the rates on every flush", func() {
+			Expect(agg.MarkTagged(testMetric, map[string]string{"host": "web1"}, 5)).To(Succeed())
+			Expect(agg.Mark(testMetric, uint8(1))).To(Succeed())
+			buffer := agg.(*aggregator).take().buffer.String()
+			for _, suffix := range []string{"count", "rate", "m1_rate", "m5_rate", "m15_rate"} {
+				Expect(buffer).To(MatchRegexp(`(?m)^%s\.%s;host=web1 [\d.]+ \d{10}$`, testMetric, suffix))
+				Expect(buffer).To(MatchRegexp(`(?m)^%s\.%s [\d.]+ \d{10}$`, testMetric, suffix))
+			}
+			agg.Flush()
+			Expect(agg.(*aggregator).GetMetrics()).To(HaveLen(2))
+		})
+
+		It("should start the interval of the new meters at the previous flush", func() {
+			agg.(*aggregator).take()
+			flushed := time.Unix(0, agg.(*aggregator).flushed)
+			Expect(agg.Mark(testMetric, 1)).To(Succeed())
+			Expect(agg.(*aggregator).GetMetrics()[testMetric].(*MetricMeter).start).To(Equal(flushed))
+		})
+	})
+
+	Context("custom aggregates", func() {
+
+		It("creates the metric with the factory only if it doesn't exist", func() {
+			created := 0
+			factory := func() Metric {
+				created++
+				return &MetricMax{}
+			}
+			Expect(agg.Update(testMetric, 5, factory)).To(Succeed())
+			Expect(agg.Update(testMetric, 8, factory)).To(Succeed())
+			Expect(created).To(Equal(1))
+			Expect(agg.(*aggregator).GetMetrics()[testMetric].Calculate()).To(Equal("8"))
+		})
+
+		It("uses the namespace and the tags of the configuration", func() {
+			agg.(*aggregator).config.Namespace = "beta"
+			agg.(*aggregator).config.Tags = map[string]string{"dc": "eu"}
+			agg.UpdateTagged(testMetric, map[string]string{"host": "web1"}, 5, func() Metric { return &MetricLast{} })
+			Expect(agg.(*aggregator).GetMetrics()).To(HaveKey("beta." + testMetric + ";dc=eu;host=web1"))
+		})
+
+		It("returns the errors of the metric or the factory", func() {
+			Expect(agg.Update(testMetric, "5", func() Metric { return &MetricLast{} })).To(HaveOccurred())
+			Expect(agg.Update(testMetric, 5, func() Metric { return nil })).To(MatchError("Unable to create the metric for " + testMetric))
+			Expect(agg.(*aggregator).GetMetrics()).To(BeEmpty())
+		})
+	})
+
+	Context("scoped views", func() {
+
+		It("adds the prefix after the namespace, joining the nested ones", func() {
+			agg.(*aggregator).config.Namespace = "beta"
+			handlers := agg.WithPrefix("http.handlers")
+			handlers.Increase("users")
+			handlers.WithPrefix("orders").AddSum("requests", 2)
+			handlers.WithPrefix("").Increase("")
+			metrics := agg.(*aggregator).GetMetrics()
+			Expect(metrics).To(HaveLen(3))
+			Expect(metrics).To(HaveKey("beta.http.handlers.users"))
+			Expect(metrics).To(HaveKey("beta.http.handlers.orders.requests"))
+			Expect(metrics).To(HaveKey("beta.http.handlers"))
+		})
+
+		It("adds the tags giving precedence to the ones received by each method", func() {
+			agg.(*aggregator).config.Tags = map[string]string{"dc": "eu", "env": "prod"}
+			scoped := agg.WithTags(map[string]string{"env": "dev", "host": "web1"}).WithTags(map[string]string{"app": "api"})
+			scoped.SetGaugeTagged(testMetric, map[string]string{"host": "web2"}, 5)
+			Expect(agg.(*aggregator).GetMetrics()).To(HaveKey(testMetric + ";app=api;dc=eu;env=dev;host=web2"))
+		})
+
+		It("shares the metrics with the aggregator", func() {
+			scoped := agg.WithPrefix("jobs").WithTags(map[string]string{"queue": "high"})
+			scoped.AddSum(testMetric, 2)
+			agg.AddSumTagged("jobs."+testMetric, map[string]string{"queue": "high"}, 3)
+			Expect(agg.(*aggregator).GetMetrics()["jobs."+testMetric+";queue=high"].Calculate()).To(Equal("5"))
+			scoped.RemoveTagged(testMetric, nil)
+			Expect(agg.(*aggregator).GetMetrics()).To(BeEmpty())
+		})
+
+		It("flushes all the metrics of the aggregator from any view", func() {
+			agg.Increase(testMetric)
+			agg.WithPrefix("jobs").Increase(testMetric)
+			_, err := agg.WithTags(map[string]string{"queue": "high"}).Flush()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(getFlushSent(client)).To(Equal(1))
+			Expect(agg.(*aggregator).GetMetrics()).To(BeEmpty())
+		})
+	})
+
 	Context("flushes the aggregates to send them to graphite", func() {
 
 		It("is thread-safe", func() {
@@ -236,6 +503,81 @@ var _ = Describe("graphite aggregator", func() {
 		})
 	})
 
+	Context("flushes with a context", func() {
+
+		It("sends the metrics if the context is not cancelled", func() {
+			agg.AddSum(testMetric, 15)
+			_, err := agg.FlushContext(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(getTotalSent(client)).To(Equal(15))
+		})
+
+		It("passes the context to the client and keeps the metrics if it fails", func() {
+			client.(*MockGraphite).MethodSendBufferContext = func(m *MockGraphite, ctx context.Context, buffer *bytes.Buffer) (int, error) {
+				return 0, ctx.Err()
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			agg.AddSum(testMetric, 15)
+			_, err := agg.FlushContext(ctx)
+			Expect(err).To(Equal(context.Canceled))
+			metrics := agg.(*aggregator).GetMetrics()
+			Expect(metrics[testMetric].Calculate()).To(Equal("15"))
+		})
+	})
+
+	Context("sends the metrics without blocking the updates", func() {
+
+		It("keeps the metrics updated while sending them", func() {
+			client.(*MockGraphite).MethodSendBuffer = func(m *MockGraphite, buffer *bytes.Buffer) (int, error) {
+				agg.AddSum(testMetric, 7)
+				return buffer.Len(), nil
+			}
+			agg.AddSum(testMetric, 5)
+			agg.Flush()
+			metrics := agg.(*aggregator).GetMetrics()
+			Expect(metrics[testMetric].Calculate()).To(Equal("7"))
+		})
+
+		It("merges the metrics that couldn't be sent with the ones updated meanwhile", func() {
+			client.(*MockGraphite).MethodSendBuffer = func(m *MockGraphite, buffer *bytes.Buffer) (int, error) {
+				agg.AddSum(testMetric, 7)
+				agg.SetMax(testMetric+".max", 3)
+				agg.SetLast(testMetric+".last", 3)
+				return 0, errors.New("Unable to send metrics to graphite")
+			}
+			agg.AddSum(testMetric, 5)
+			agg.SetMax(testMetric+".max", 10)
+			agg.SetLast(testMetric+".last", 10)
+			agg.SetMin(testMetric+".min", 1)
+			_, err := agg.Flush()
+			Expect(err).To(HaveOccurred())
+			metrics := agg.(*aggregator).GetMetrics()
+			Expect(metrics[testMetric].Calculate()).To(Equal("12"))
+			Expect(metrics[testMetric+".max"].Calculate()).To(Equal("10"))
+			Expect(metrics[testMetric+".last"].Calculate()).To(Equal("3"))
+			Expect(metrics[testMetric+".min"].Calculate()).To(Equal("1"))
+		})
+
+		It("doesn't block other aggregators while sending", func() {
+			sending := make(chan bool)
+			release := make(chan bool)
+			client.(*MockGraphite).MethodSendBuffer = func(m *MockGraphite, buffer *bytes.Buffer) (int, error) {
+				sending <- true
+				<-release
+				return buffer.Len(), nil
+			}
+			other := newAggregator(&Config{}, client)
+			agg.AddSum(testMetric, 5)
+			go agg.Flush()
+			<-sending
+			other.AddSum(testMetric, 3)
+			agg.AddSum(testMetric, 2)
+			close(release)
+			Expect(other.(*aggregator).GetMetrics()[testMetric].Calculate()).To(Equal("3"))
+		})
+	})
+
 	Context("runs periodically", func() {
 
 		var (
@@ -244,11 +586,7 @@ var _ = Describe("graphite aggregator", func() {
 
 		BeforeEach(func() {
 			stop = make(chan bool)
-			agg = &aggregator{
-				config:  &Config{},
-				client:  client,
-				metrics: map[string]Metric{},
-			}
+			agg = newAggregator(&Config{}, client)
 		})
 
 		It("flushes every tick", func() {
@@ -295,16 +633,74 @@ var _ = Describe("graphite aggregator", func() {
 		})
 	})
 
+	Context("stops gracefully", func() {
+
+		It("stops the periodic flushing and sends the metrics stored", func() {
+			agg.Run(time.Hour, nil)
+			agg.AddSum(testMetric, 15)
+			Expect(agg.Stop(context.Background())).To(Succeed())
+			Expect(getTotalSent(client)).To(Equal(15))
+			Expect(agg.(*aggregator).GetMetrics()).To(BeEmpty())
+		})
+
+		It("waits for the flush in progress before sending the metrics stored", func() {
+			sending := make(chan bool, 1)
+			release := make(chan bool)
+			sent := []string{}
+			client.(*MockGraphite).MethodSendBuffer = func(m *MockGraphite, buffer *bytes.Buffer) (int, error) {
+				sending <- true
+				<-release
+				mutex.Lock()
+				defer mutex.Unlock()
+				sent = append(sent, buffer.String())
+				return buffer.Len(), nil
+			}
+			agg.Run(10*time.Millisecond, nil)
+			agg.AddSum(testMetric, 15)
+			<-sending
+			agg.AddSum(testMetric, 25)
+			stopped := make(chan error)
+			go func() {
+				stopped <- agg.Close()
+			}()
+			Consistently(stopped).ShouldNot(Receive())
+			close(release)
+			Eventually(stopped).Should(Receive(BeNil()))
+			Expect(sent).To(HaveLen(2))
+			Expect(sent[0]).To(HavePrefix(testMetric + " 15 "))
+			Expect(sent[1]).To(HavePrefix(testMetric + " 25 "))
+		})
+
+		It("retries once and returns the error if the metrics can't be sent", func() {
+			agg.AddSum(failMetric, 15)
+			err := agg.Close()
+			Expect(err).To(MatchError("Unable to send metrics to graphite"))
+			Expect(getFlushSent(client)).To(Equal(2))
+			Expect(client.(*MockGraphite).Extra).To(HaveKey("reconnected"))
+		})
+
+		It("returns the error of the context if it's done before finishing", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			agg.Run(time.Hour, nil)
+			agg.(*aggregator).running.Add(1)
+			defer agg.(*aggregator).running.Done()
+			Expect(agg.Stop(ctx)).To(Equal(context.Canceled))
+		})
+
+		It("can be stopped several times", func() {
+			agg.Run(time.Hour, nil)
+			Expect(agg.Close()).To(Succeed())
+			agg.AddSum(testMetric, 15)
+			Expect(agg.Close()).To(Succeed())
+			Expect(getTotalSent(client)).To(Equal(15))
+		})
+	})
+
 	Context("uses client configuration", func() {
 
 		It("uses the namespace/prefix before sending metrics", func() {
-			agg = &aggregator{
-				config: &Config{
-					Namespace: "beta.instance",
-				},
-				client:  client,
-				metrics: map[string]Metric{},
-			}
+			agg = newAggregator(&Config{Namespace: "beta.instance"}, client)
 			agg.AddSum(testMetric, 5000)
 			metrics := agg.(*aggregator).GetMetrics()
 			Expect(metrics["beta.instance."+testMetric].Calculate()).To(Equal("5000"))
@@ -0,0 +1,164 @@
+package graphite
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Alignment specifies how the timestamps of the metrics sent by the aggregator are aligned.
+type Alignment string
+
+const (
+	// AlignmentNone sends the metrics with the timestamp of the flush.
+	AlignmentNone Alignment = ""
+	// AlignmentStart sends the metrics with the timestamp of the start of the interval they
+	// were aggregated in: the time of the flush floored to the interval, minus the interval.
+	AlignmentStart Alignment = "start"
+	// AlignmentEnd sends the metrics with the timestamp of the end of the interval they
+	// were aggregated in: the time of the flush floored to the interval.
+	AlignmentEnd Alignment = "end"
+)
+
+// StorageSchema is a rule of the storage-schemas.conf file of carbon, specifying the retentions
+// of the metrics matching a pattern.
+type StorageSchema struct {
+	Name    string
+	Pattern *regexp.Regexp
+	// Precision is the precision of the finest retention of the rule.
+	Precision time.Duration
+}
+
+// StorageSchemas is the list of rules of the storage-schemas.conf file of carbon, in the same
+// order as they are defined, as carbon uses the first one matching the metric.
+type StorageSchemas []StorageSchema
+
+// LoadStorageSchemas reads the rules of the storage-schemas.conf file of carbon, so the aggregator
+// can align the timestamps of each metric to the finest retention matching it.
+//
+//         schemas, err := graphite.LoadStorageSchemas("/etc/carbon/storage-schemas.conf")
+//         if err != nil {
+//             return err
+//         }
+//         config.StorageSchemas = schemas
+func LoadStorageSchemas(path string) (StorageSchemas, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open the storage schemas: %s", err.Error())
+	}
+	defer file.Close()
+	schemas := StorageSchemas{}
+	var current *StorageSchema
+	var pattern, retentions string
+	add := func() error {
+		if current == nil {
+			return nil
+		}
+		if pattern == "" || retentions == "" {
+			return fmt.Errorf("Invalid storage schema %s: pattern and retentions are required", current.Name)
+		}
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid pattern of the storage schema %s: %s", current.Name, err.Error())
+		}
+		precision, err := parsePrecision(strings.Split(retentions, ",")[0])
+		if err != nil {
+			return fmt.Errorf("Invalid retentions of the storage schema %s: %s", current.Name, err.Error())
+		}
+		current.Pattern, current.Precision = compiled, precision
+		schemas = append(schemas, *current)
+		return nil
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			if err := add(); err != nil {
+				return nil, err
+			}
+			current = &StorageSchema{Name: strings.TrimSpace(line[1 : len(line)-1])}
+			pattern, retentions = "", ""
+			continue
+		}
+		pair := strings.SplitN(line, "=", 2)
+		if len(pair) != 2 || current == nil {
+			continue
+		}
+		switch strings.TrimSpace(pair[0]) {
+		case "pattern":
+			pattern = strings.TrimSpace(pair[1])
+		case "retentions":
+			retentions = strings.TrimSpace(pair[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to read the storage schemas: %s", err.Error())
+	}
+	if err := add(); err != nil {
+		return nil, err
+	}
+	return schemas, nil
+}
+
+// getPrecision returns the precision of the first rule matching the name of the series.
+func (schemas StorageSchemas) getPrecision(series string) (time.Duration, bool) {
+	name, _ := parseSeries(series)
+	for _, schema := range schemas {
+		if schema.Pattern != nil && schema.Pattern.MatchString(name) {
+			return schema.Precision, true
+		}
+	}
+	return 0, false
+}
+
+// precisionUnits are the units allowed by carbon in the retentions, in seconds.
+var precisionUnits = map[string]int64{
+	"s": 1, "sec": 1, "second": 1, "seconds": 1,
+	"m": 60, "min": 60, "minute": 60, "minutes": 60,
+	"h": 3600, "hour": 3600, "hours": 3600,
+	"d": 86400, "day": 86400, "days": 86400,
+	"w": 604800, "week": 604800, "weeks": 604800,
+	"y": 31536000, "year": 31536000, "years": 31536000,
+}
+
+// parsePrecision parses the precision of a retention in the format precision:duration, where the
+// precision is either a number of seconds or a number followed by a unit, like 10s or 1m.
+func parsePrecision(retention string) (time.Duration, error) {
+	precision := strings.TrimSpace(strings.SplitN(retention, ":", 2)[0])
+	i := strings.IndexFunc(precision, func(r rune) bool { return r < '0' || r > '9' })
+	number, unit := precision, "s"
+	if i >= 0 {
+		number, unit = precision[:i], precision[i:]
+	}
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("Invalid precision %s", precision)
+	}
+	seconds, ok := precisionUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("Invalid precision unit %s", unit)
+	}
+	return time.Duration(value*seconds) * time.Second, nil
+}
+
+// align returns the timestamp of the time aligned to the interval, floored from the Unix epoch
+// like carbon does with the retentions.
+func align(now time.Time, interval time.Duration, alignment Alignment) int64 {
+	timestamp := now.Unix()
+	seconds := int64(interval / time.Second)
+	if alignment == AlignmentNone || seconds <= 0 {
+		return timestamp
+	}
+	end := timestamp - timestamp%seconds
+	if alignment == AlignmentStart {
+		return end - seconds
+	}
+	return end
+}
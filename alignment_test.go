@@ -0,0 +1,111 @@
+package graphite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("timestamp alignment", func() {
+
+	var (
+		now = time.Unix(1554992147, 0)
+	)
+
+	It("keeps the timestamp if there is no alignment or interval", func() {
+		Expect(align(now, 30*time.Second, AlignmentNone)).To(Equal(int64(1554992147)))
+		Expect(align(now, 0, AlignmentEnd)).To(Equal(int64(1554992147)))
+	})
+
+	It("floors the timestamp to the end of the interval", func() {
+		Expect(align(now, 30*time.Second, AlignmentEnd)).To(Equal(int64(1554992130)))
+		Expect(align(now, time.Minute, AlignmentEnd)).To(Equal(int64(1554992100)))
+	})
+
+	It("floors the timestamp to the start of the interval", func() {
+		Expect(align(now, 30*time.Second, AlignmentStart)).To(Equal(int64(1554992100)))
+	})
+
+	Context("storage schemas", func() {
+
+		var (
+			dir  string
+			path string
+		)
+
+		BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "graphite-schemas")
+			path = filepath.Join(dir, "storage-schemas.conf")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("reads the finest retention of each schema in order", func() {
+			ioutil.WriteFile(path, []byte(`
+# Schema definitions for Whisper files.
+[carbon]
+pattern = ^carbon\.
+retentions = 60:90d
+
+[collectd]
+pattern = ^collectd\.
+retentions = 10s:1d, 1min:7d,10min:1y
+
+[default_1min_for_1day]
+pattern = .*
+retentions = 1m:1d
+`), 0644)
+			schemas, err := LoadStorageSchemas(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(schemas).To(HaveLen(3))
+			Expect(schemas[0].Name).To(Equal("carbon"))
+			Expect(schemas[0].Precision).To(Equal(time.Minute))
+			Expect(schemas[1].Precision).To(Equal(10 * time.Second))
+			precision, ok := schemas.getPrecision("collectd.cpu;host=web1")
+			Expect(ok).To(BeTrue())
+			Expect(precision).To(Equal(10 * time.Second))
+			precision, _ = schemas.getPrecision("app.requests")
+			Expect(precision).To(Equal(time.Minute))
+		})
+
+		It("returns an error if a schema is invalid", func() {
+			ioutil.WriteFile(path, []byte("[broken]\npattern = ^app\\.\nretentions = 10x:1d\n"), 0644)
+			_, err := LoadStorageSchemas(path)
+			Expect(err).To(MatchError("Invalid retentions of the storage schema broken: Invalid precision unit x"))
+		})
+
+		It("returns an error if the file can't be read", func() {
+			_, err := LoadStorageSchemas(filepath.Join(dir, "missing.conf"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("used by the aggregator", func() {
+
+		It("aligns the timestamps to the schema, the configuration or the period to flush", func() {
+			schemas := StorageSchemas{{Name: "fine", Pattern: regexp.MustCompile(`^fine\.`), Precision: 10 * time.Second}}
+			agg := newAggregator(&Config{Alignment: AlignmentEnd, StorageSchemas: schemas}, &MockGraphite{}).(*aggregator)
+			Expect(agg.getTimestamp("fine.metric", now)).To(Equal(int64(1554992140)))
+			Expect(agg.getTimestamp("other.metric", now)).To(Equal(int64(1554992147)))
+			agg.period = int64(time.Minute)
+			Expect(agg.getTimestamp("other.metric", now)).To(Equal(int64(1554992100)))
+			agg.config.AlignmentInterval = 30 * time.Second
+			Expect(agg.getTimestamp("other.metric", now)).To(Equal(int64(1554992130)))
+		})
+
+		It("sends the metrics with the timestamp aligned", func() {
+			agg := newAggregator(&Config{Alignment: AlignmentEnd, AlignmentInterval: time.Hour}, &MockGraphite{}).(*aggregator)
+			agg.AddSum("metric", 5)
+			buffer := agg.take().buffer.String()
+			hour := time.Now().Unix() - time.Now().Unix()%3600
+			Expect(buffer).To(Or(Equal(format("metric", "5", hour)), Equal(format("metric", "5", hour-3600))))
+		})
+	})
+})
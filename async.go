@@ -0,0 +1,322 @@
+package graphite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultQueueSize specifies the default amount of metric lines an asynchronous client can hold.
+	DefaultQueueSize = 10000
+	// DefaultQueueTimeout specifies the default time an asynchronous client using OverflowBlock
+	// waits for space in the queue.
+	DefaultQueueTimeout = 1 * time.Second
+	// queueBatchSize specifies the maximum amount of lines the writer sends at once.
+	queueBatchSize = 1000
+)
+
+// OverflowPolicy specifies what an asynchronous client does when its queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDropNewest discards the metrics being enqueued when the queue is full.
+	OverflowDropNewest OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest metrics of the queue to make room for the new ones.
+	OverflowDropOldest
+	// OverflowBlock waits up to QueueTimeout for room in the queue, discarding the metrics afterwards.
+	OverflowBlock
+)
+
+var (
+	// ErrQueueFull is returned by an asynchronous client when some metrics were dropped
+	// because the queue was full.
+	ErrQueueFull = errors.New("The queue is full, metrics were dropped")
+	// ErrQueueClosed is returned by an asynchronous client when sending metrics after closing it.
+	ErrQueueClosed = errors.New("The queue is closed")
+)
+
+// QueueStats stores the counters of metric lines processed by an asynchronous client.
+type QueueStats struct {
+	// Enqueued is the amount of lines accepted in the queue.
+	Enqueued uint64
+	// Sent is the amount of lines successfully written to graphite.
+	Sent uint64
+	// Dropped is the amount of lines discarded because the queue was full.
+	Dropped uint64
+	// Failed is the amount of lines discarded because they couldn't be written to graphite.
+	Failed uint64
+}
+
+// AsyncGraphite is an interface for a graphite client that sends the metrics in background.
+type AsyncGraphite interface {
+	Graphite
+	Stats() QueueStats
+	Close() error
+}
+
+type async struct {
+	stats  QueueStats
+	config *Config
+	client Graphite
+	queue  chan string
+	done   chan struct{}
+	closed bool
+	mutex  sync.RWMutex
+	// writing guards the wrapped client, used both by the writer and the connection methods.
+	writing sync.Mutex
+	// enqueuing serializes the buffers being enqueued, so each one is enqueued as a whole.
+	enqueuing sync.Mutex
+	// room is signaled by the writer every time it takes metrics from the queue.
+	room chan struct{}
+}
+
+// NewGraphiteAsync wraps a graphite client so Send and SendBuffer only enqueue the metrics in a bounded
+// in-memory queue, which is drained by a background writer using the wrapped client. This way the
+// callers are never blocked by a slow graphite. The size of the queue and what happens when it's full
+// are set through QueueSize, QueueOverflow and QueueTimeout in the configuration.
+//
+//         import graphite "github.com/gguridi/graphite-client"
+//
+//         config := &graphite.Config{
+//             Host:          "example.com",
+//             Port:          2003,
+//             QueueOverflow: graphite.OverflowDropOldest,
+//         }
+//         client := graphite.NewGraphiteAsync(config, graphite.NewGraphiteTCP(config))
+//         defer client.Close()
+func NewGraphiteAsync(config *Config, client Graphite) AsyncGraphite {
+	async := &async{
+		config: config,
+		client: client,
+		queue:  make(chan string, config.getQueueSize()),
+		done:   make(chan struct{}),
+		room:   make(chan struct{}, 1),
+	}
+	go async.run()
+	return async
+}
+
+// Connect establishes a connection using the wrapped client.
+func (async *async) Connect() error {
+	async.writing.Lock()
+	defer async.writing.Unlock()
+	return async.client.Connect()
+}
+
+// ConnectContext establishes a connection using the wrapped client, honouring the context.
+func (async *async) ConnectContext(ctx context.Context) error {
+	async.writing.Lock()
+	defer async.writing.Unlock()
+	return async.client.ConnectContext(ctx)
+}
+
+// Reconnect reconnects using the wrapped client.
+func (async *async) Reconnect() error {
+	async.writing.Lock()
+	defer async.writing.Unlock()
+	return async.client.Reconnect()
+}
+
+// Disconnect closes the connection of the wrapped client. The queue will keep accepting metrics,
+// reconnecting when they are written. Use Close to stop the client.
+func (async *async) Disconnect() error {
+	async.writing.Lock()
+	defer async.writing.Unlock()
+	return async.client.Disconnect()
+}
+
+// NewAggregator returns a new aggregator that will flush its metrics through the queue.
+func (async *async) NewAggregator() Aggregator {
+	return newAggregator(async.config, async)
+}
+
+// Send enqueues a metric to be sent to graphite, returning the amount of bytes enqueued.
+func (async *async) Send(path, value string) (int, error) {
+	return async.SendContext(context.Background(), path, value)
+}
+
+// SendContext enqueues a metric like Send. When using OverflowBlock it stops waiting for room
+// in the queue if the context is cancelled or its deadline is exceeded.
+func (async *async) SendContext(ctx context.Context, path, value string) (int, error) {
+	return sendMetric(ctx, async, async.config, path, nil, value, time.Now())
+}
+
+// SendTagged is used to send a metric like Send, using the graphite 1.1 tagged series format.
+func (async *async) SendTagged(path string, tags map[string]string, value string) (int, error) {
+	return sendMetric(context.Background(), async, async.config, path, tags, value, time.Now())
+}
+
+// SendAt is used to send a metric like Send, with the timestamp received instead of the current time.
+func (async *async) SendAt(path string, value string, timestamp time.Time) (int, error) {
+	return async.SendAtContext(context.Background(), path, value, timestamp)
+}
+
+// SendAtContext is used to send a metric like SendAt, honouring the cancellation and deadline
+// of the context.
+func (async *async) SendAtContext(ctx context.Context, path string, value string, timestamp time.Time) (int, error) {
+	return sendMetric(ctx, async, async.config, path, nil, value, timestamp)
+}
+
+// SendPoints is used to send a batch of points, each one of them with its own timestamp, in
+// chunks of `BackfillChunkSize` and not exceeding the `BackfillRate` of the configuration.
+func (async *async) SendPoints(points []Point) (int, error) {
+	return async.SendPointsContext(context.Background(), points)
+}
+
+// SendPointsContext is used to send a batch of points like SendPoints, honouring the cancellation
+// and deadline of the context.
+func (async *async) SendPointsContext(ctx context.Context, points []Point) (int, error) {
+	return sendPoints(ctx, async, async.config, points)
+}
+
+// SendBuffer enqueues all the metrics of the buffer to be sent to graphite, returning the amount of
+// bytes enqueued. The buffer is enqueued as a whole: if there is no room for all its metrics none of
+// them are enqueued and ErrQueueFull is returned, unless using OverflowDropOldest.
+func (async *async) SendBuffer(buffer *bytes.Buffer) (int, error) {
+	return async.SendBufferContext(context.Background(), buffer)
+}
+
+// SendBufferContext enqueues all the metrics of the buffer like SendBuffer. When using OverflowBlock
+// it stops waiting for room in the queue if the context is cancelled or its deadline is exceeded.
+func (async *async) SendBufferContext(ctx context.Context, buffer *bytes.Buffer) (int, error) {
+	async.mutex.RLock()
+	defer async.mutex.RUnlock()
+	if async.closed {
+		return 0, ErrQueueClosed
+	}
+	lines := []string{}
+	for _, line := range strings.Split(buffer.String(), "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line+"\n")
+		}
+	}
+	async.enqueuing.Lock()
+	defer async.enqueuing.Unlock()
+	if !async.reserve(ctx, len(lines)) {
+		atomic.AddUint64(&async.stats.Dropped, uint64(len(lines)))
+		return 0, ErrQueueFull
+	}
+	total := 0
+	for _, line := range lines {
+		async.enqueue(line)
+		atomic.AddUint64(&async.stats.Enqueued, 1)
+		total += len(line)
+	}
+	return total, nil
+}
+
+// Stats returns the counters of the metric lines processed till this point.
+func (async *async) Stats() QueueStats {
+	return QueueStats{
+		Enqueued: atomic.LoadUint64(&async.stats.Enqueued),
+		Sent:     atomic.LoadUint64(&async.stats.Sent),
+		Dropped:  atomic.LoadUint64(&async.stats.Dropped),
+		Failed:   atomic.LoadUint64(&async.stats.Failed),
+	}
+}
+
+// Close stops accepting new metrics and waits until the background writer has sent all the
+// metrics remaining in the queue.
+func (async *async) Close() error {
+	async.mutex.Lock()
+	if !async.closed {
+		async.closed = true
+		close(async.queue)
+	}
+	async.mutex.Unlock()
+	<-async.done
+	return nil
+}
+
+// reserve returns whether there is room in the queue for the amount of metrics received, following
+// the overflow policy of the configuration. As the buffers are enqueued one at a time, the room can
+// only grow until they are enqueued.
+func (async *async) reserve(ctx context.Context, count int) bool {
+	if async.config.QueueOverflow == OverflowDropOldest {
+		return true
+	}
+	if count > cap(async.queue) {
+		return false
+	}
+	if cap(async.queue)-len(async.queue) >= count {
+		return true
+	}
+	if async.config.QueueOverflow != OverflowBlock {
+		return false
+	}
+	timer := time.NewTimer(async.config.getQueueTimeout())
+	defer timer.Stop()
+	for {
+		select {
+		case <-async.room:
+			if cap(async.queue)-len(async.queue) >= count {
+				return true
+			}
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// enqueue adds the metric to the queue, discarding the oldest ones if there is no room for it.
+func (async *async) enqueue(line string) {
+	for {
+		select {
+		case async.queue <- line:
+			return
+		default:
+		}
+		select {
+		case <-async.queue:
+			atomic.AddUint64(&async.stats.Dropped, 1)
+		default:
+		}
+	}
+}
+
+func (async *async) run() {
+	defer close(async.done)
+	for line := range async.queue {
+		buffer := bytes.NewBufferString(line)
+		count := uint64(1)
+		for drained := false; !drained && count < queueBatchSize; {
+			select {
+			case next, ok := <-async.queue:
+				if !ok {
+					drained = true
+					break
+				}
+				buffer.WriteString(next)
+				count++
+			default:
+				drained = true
+			}
+		}
+		select {
+		case async.room <- struct{}{}:
+		default:
+		}
+		if err := async.write(buffer); err != nil {
+			log.Printf("Unable to send queued metrics: %s\n", err.Error())
+			atomic.AddUint64(&async.stats.Failed, count)
+		} else {
+			atomic.AddUint64(&async.stats.Sent, count)
+		}
+	}
+}
+
+// write sends the buffer using the wrapped client.
+func (async *async) write(buffer *bytes.Buffer) error {
+	async.writing.Lock()
+	defer async.writing.Unlock()
+	_, err := async.client.SendBuffer(buffer)
+	return err
+}
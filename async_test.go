@@ -0,0 +1,192 @@
+package graphite
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("asynchronous client", func() {
+
+	var (
+		client  *MockGraphite
+		config  *Config
+		release chan bool
+		sent    []string
+		mutex   = &sync.Mutex{}
+	)
+
+	var getSent = func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string{}, sent...)
+	}
+
+	BeforeEach(func() {
+		sent = []string{}
+		release = make(chan bool)
+		config = &Config{QueueSize: 2}
+		client = &MockGraphite{
+			Data: map[string]string{},
+			MethodSendBuffer: func(m *MockGraphite, buffer *bytes.Buffer) (int, error) {
+				<-release
+				mutex.Lock()
+				defer mutex.Unlock()
+				for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+					sent = append(sent, line)
+				}
+				if strings.Contains(buffer.String(), "force.fail") {
+					return 0, errors.New("Unable to send metrics to graphite")
+				}
+				return buffer.Len(), nil
+			},
+		}
+	})
+
+	// blockWriter enqueues a first metric and waits until the writer has taken it, so the writer
+	// stays blocked and the queue can be filled deterministically.
+	var blockWriter = func(queued AsyncGraphite) {
+		queued.SendBuffer(bytes.NewBufferString("blocking 0 1554992147\n"))
+		Eventually(func() int { return len(queued.(*async).queue) }).Should(Equal(0))
+	}
+
+	var closeAsync = func(queued AsyncGraphite) {
+		close(release)
+		Expect(queued.Close()).To(Succeed())
+	}
+
+	It("should implement AsyncGraphite interface", func() {
+		var _ AsyncGraphite = (*async)(nil)
+	})
+
+	It("enqueues the metrics and sends them in background", func() {
+		queued := NewGraphiteAsync(config, client)
+		n, err := queued.SendBuffer(bytes.NewBufferString("metricA 1 1554992147\nmetricB 2 1554992147\n"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(42))
+		closeAsync(queued)
+		Expect(getSent()).To(Equal([]string{"metricA 1 1554992147", "metricB 2 1554992147"}))
+		Expect(queued.Stats()).To(Equal(QueueStats{Enqueued: 2, Sent: 2}))
+	})
+
+	It("drops the newest metrics when the queue is full by default", func() {
+		queued := NewGraphiteAsync(config, client)
+		blockWriter(queued)
+		queued.Send("metricA", "1")
+		n, err := queued.SendBuffer(bytes.NewBufferString("b 2 1554992147\nc 3 1554992147\n"))
+		Expect(err).To(Equal(ErrQueueFull))
+		Expect(n).To(Equal(0))
+		closeAsync(queued)
+		Expect(getSent()).To(HaveLen(2))
+		Expect(getSent()[1]).To(MatchRegexp(`^metricA 1 \d{10}$`))
+		Expect(queued.Stats()).To(Equal(QueueStats{Enqueued: 2, Sent: 2, Dropped: 2}))
+	})
+
+	It("doesn't enqueue any metric of the buffers bigger than the queue", func() {
+		queued := NewGraphiteAsync(config, client)
+		n, err := queued.SendBuffer(bytes.NewBufferString("a 1 1554992147\nb 2 1554992147\nc 3 1554992147\n"))
+		Expect(err).To(Equal(ErrQueueFull))
+		Expect(n).To(Equal(0))
+		closeAsync(queued)
+		Expect(getSent()).To(BeEmpty())
+		Expect(queued.Stats()).To(Equal(QueueStats{Dropped: 3}))
+	})
+
+	It("drops the oldest metrics when the queue is full if configured", func() {
+		config.QueueOverflow = OverflowDropOldest
+		queued := NewGraphiteAsync(config, client)
+		blockWriter(queued)
+		_, err := queued.SendBuffer(bytes.NewBufferString("a 1 1554992147\nb 2 1554992147\nc 3 1554992147\n"))
+		Expect(err).ToNot(HaveOccurred())
+		closeAsync(queued)
+		Expect(getSent()).To(Equal([]string{"blocking 0 1554992147", "b 2 1554992147", "c 3 1554992147"}))
+		Expect(queued.Stats()).To(Equal(QueueStats{Enqueued: 4, Sent: 3, Dropped: 1}))
+	})
+
+	It("blocks until there is room in the queue for the whole buffer if configured", func() {
+		config.QueueOverflow = OverflowBlock
+		queued := NewGraphiteAsync(config, client)
+		blockWriter(queued)
+		queued.Send("metricA", "1")
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			release <- true
+		}()
+		_, err := queued.SendBuffer(bytes.NewBufferString("b 2 1554992147\nc 3 1554992147\n"))
+		Expect(err).ToNot(HaveOccurred())
+		closeAsync(queued)
+		Expect(queued.Stats()).To(Equal(QueueStats{Enqueued: 4, Sent: 4}))
+	})
+
+	It("drops the metrics if the queue is still full after the timeout", func() {
+		config.QueueOverflow = OverflowBlock
+		config.QueueTimeout = 50 * time.Millisecond
+		queued := NewGraphiteAsync(config, client)
+		blockWriter(queued)
+		queued.Send("metricA", "1")
+		n, err := queued.SendBuffer(bytes.NewBufferString("b 2 1554992147\nc 3 1554992147\n"))
+		Expect(err).To(Equal(ErrQueueFull))
+		Expect(n).To(Equal(0))
+		closeAsync(queued)
+		Expect(queued.Stats()).To(Equal(QueueStats{Enqueued: 2, Sent: 2, Dropped: 2}))
+	})
+
+	It("counts the metrics that couldn't be sent", func() {
+		queued := NewGraphiteAsync(config, client)
+		queued.Send("force.fail", "1")
+		closeAsync(queued)
+		Expect(queued.Stats()).To(Equal(QueueStats{Enqueued: 1, Failed: 1}))
+	})
+
+	It("doesn't use the wrapped client from the writer and the connection methods at once", func() {
+		var using, overlapped int32
+		var use = func() {
+			if !atomic.CompareAndSwapInt32(&using, 0, 1) {
+				atomic.StoreInt32(&overlapped, 1)
+				return
+			}
+			time.Sleep(time.Millisecond)
+			atomic.StoreInt32(&using, 0)
+		}
+		client.MethodSendBuffer = func(m *MockGraphite, buffer *bytes.Buffer) (int, error) {
+			use()
+			return buffer.Len(), nil
+		}
+		client.MethodReconnect = func(m *MockGraphite) error {
+			use()
+			return nil
+		}
+		config.QueueSize = 100
+		queued := NewGraphiteAsync(config, client)
+		for i := 0; i < 20; i++ {
+			queued.Send("metricA", "1")
+			queued.Reconnect()
+		}
+		closeAsync(queued)
+		Expect(atomic.LoadInt32(&overlapped)).To(BeZero())
+	})
+
+	It("doesn't accept metrics after being closed", func() {
+		queued := NewGraphiteAsync(config, client)
+		closeAsync(queued)
+		_, err := queued.Send("metricA", "1")
+		Expect(err).To(Equal(ErrQueueClosed))
+	})
+
+	It("returns aggregators flushing through the queue", func() {
+		queued := NewGraphiteAsync(config, client)
+		aggregator := queued.NewAggregator()
+		aggregator.AddSum("metricA", 5)
+		_, err := aggregator.Flush()
+		Expect(err).ToNot(HaveOccurred())
+		closeAsync(queued)
+		Expect(getSent()).To(HaveLen(1))
+		Expect(getSent()[0]).To(MatchRegexp(`^metricA 5 \d{10}$`))
+	})
+})
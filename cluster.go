@@ -0,0 +1,239 @@
+package graphite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Destination specifies one of the graphite servers where a cluster client sends metrics.
+type Destination struct {
+	// Host is a string specifying the address where the carbon instance is listening.
+	Host string
+	// Port is an integer specifying the port where the carbon instance is listening.
+	Port int
+	// Instance is an optional name identifying the carbon instance, as used in the
+	// carbon-relay DESTINATIONS setting (host:port:instance).
+	Instance string
+}
+
+// key returns the identifier of the destination in the hashing ring, which matches the
+// representation of the (server, instance) tuple used by carbon-relay.
+func (destination Destination) key() string {
+	return destination.serverKey(destination.Host)
+}
+
+// portKey returns the identifier of the destination including its port, used when several
+// destinations share the same host and instance and their keys would collide.
+func (destination Destination) portKey() string {
+	return destination.serverKey(fmt.Sprintf("%s:%d", destination.Host, destination.Port))
+}
+
+func (destination Destination) serverKey(server string) string {
+	instance := "None"
+	if destination.Instance != "" {
+		instance = fmt.Sprintf("'%s'", destination.Instance)
+	}
+	return fmt.Sprintf("('%s', %s)", server, instance)
+}
+
+// destinationKeys returns the identifiers of the destinations in the hashing ring. The destinations
+// colliding because they only differ in the port are identified including it, and the duplicated
+// ones are discarded.
+func destinationKeys(destinations []Destination) ([]string, []Destination) {
+	ports := map[string]map[int]bool{}
+	for _, destination := range destinations {
+		if ports[destination.key()] == nil {
+			ports[destination.key()] = map[int]bool{}
+		}
+		ports[destination.key()][destination.Port] = true
+	}
+	keys := []string{}
+	unique := []Destination{}
+	seen := map[string]bool{}
+	for _, destination := range destinations {
+		key := destination.key()
+		if len(ports[key]) > 1 {
+			key = destination.portKey()
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+		unique = append(unique, destination)
+	}
+	return keys, unique
+}
+
+type cluster struct {
+	config  *Config
+	ring    *hashRing
+	keys    []string
+	clients map[string]Graphite
+}
+
+// NewGraphiteCluster creates a new graphite client that shards the metrics between several destinations
+// using the same consistent hashing as carbon-relay, so there is no need to use a relay in the middle.
+// Each metric is sent to as many destinations as specified by ReplicationFactor in the configuration.
+// All the destinations share the same configuration, except for the host and the port. The
+// destinations in the same host should be given an Instance, like in carbon-relay, otherwise
+// they are identified in the ring by their port too.
+//
+//         import graphite "github.com/gguridi/graphite-client"
+//
+//         client := graphite.NewGraphiteCluster(&graphite.Config{
+//             ReplicationFactor: 2,
+//         }, graphite.ProtocolPickle, []graphite.Destination{
+//             {Host: "carbon1.example.com", Port: 2004},
+//             {Host: "carbon2.example.com", Port: 2004},
+//             {Host: "carbon3.example.com", Port: 2004},
+//         })
+func NewGraphiteCluster(config *Config, protocol string, destinations []Destination) Graphite {
+	cluster := &cluster{
+		config:  config,
+		clients: map[string]Graphite{},
+	}
+	keys, destinations := destinationKeys(destinations)
+	for i, destination := range destinations {
+		destinationConfig := *config
+		destinationConfig.Host = destination.Host
+		destinationConfig.Port = destination.Port
+		cluster.clients[keys[i]] = newGraphite(&destinationConfig, protocol)
+	}
+	cluster.keys = keys
+	cluster.ring = newHashRing(cluster.keys)
+	return cluster
+}
+
+// Connect establishes a connection with all the destinations, returning an error if any of them failed.
+func (cluster *cluster) Connect() error {
+	return cluster.ConnectContext(context.Background())
+}
+
+// ConnectContext establishes a connection with all the destinations like Connect, honouring
+// the cancellation and deadline of the context.
+func (cluster *cluster) ConnectContext(ctx context.Context) error {
+	return cluster.each(func(client Graphite) error {
+		return client.ConnectContext(ctx)
+	})
+}
+
+// Reconnect tries to close the previous connections and reconnect with all the destinations.
+func (cluster *cluster) Reconnect() error {
+	return cluster.each(func(client Graphite) error {
+		return client.Reconnect()
+	})
+}
+
+// Disconnect tries to close the connections with all the destinations.
+func (cluster *cluster) Disconnect() error {
+	return cluster.each(func(client Graphite) error {
+		return client.Disconnect()
+	})
+}
+
+// NewAggregator returns a new aggregator that will shard its metrics through the cluster.
+func (cluster *cluster) NewAggregator() Aggregator {
+	return newAggregator(cluster.config, cluster)
+}
+
+// Send is used to immediately send a metric to the destinations owning its path.
+func (cluster *cluster) Send(path, value string) (int, error) {
+	return cluster.SendContext(context.Background(), path, value)
+}
+
+// SendContext is used to immediately send a metric like Send, honouring the cancellation and
+// deadline of the context.
+func (cluster *cluster) SendContext(ctx context.Context, path, value string) (int, error) {
+	return sendMetric(ctx, cluster, cluster.config, path, nil, value, time.Now())
+}
+
+// SendTagged is used to send a metric like Send, using the graphite 1.1 tagged series format.
+func (cluster *cluster) SendTagged(path string, tags map[string]string, value string) (int, error) {
+	return sendMetric(context.Background(), cluster, cluster.config, path, tags, value, time.Now())
+}
+
+// SendAt is used to send a metric like Send, with the timestamp received instead of the current time.
+func (cluster *cluster) SendAt(path string, value string, timestamp time.Time) (int, error) {
+	return cluster.SendAtContext(context.Background(), path, value, timestamp)
+}
+
+// SendAtContext is used to send a metric like SendAt, honouring the cancellation and deadline
+// of the context.
+func (cluster *cluster) SendAtContext(ctx context.Context, path string, value string, timestamp time.Time) (int, error) {
+	return sendMetric(ctx, cluster, cluster.config, path, nil, value, timestamp)
+}
+
+// SendPoints is used to send a batch of points, each one of them with its own timestamp, in
+// chunks of `BackfillChunkSize` and not exceeding the `BackfillRate` of the configuration.
+func (cluster *cluster) SendPoints(points []Point) (int, error) {
+	return cluster.SendPointsContext(context.Background(), points)
+}
+
+// SendPointsContext is used to send a batch of points like SendPoints, honouring the cancellation
+// and deadline of the context.
+func (cluster *cluster) SendPointsContext(ctx context.Context, points []Point) (int, error) {
+	return sendPoints(ctx, cluster, cluster.config, points)
+}
+
+// SendBuffer splits the buffer received between the destinations owning each one of the metrics,
+// returning the total amount of bytes sent. If some destinations fail, the metrics are still
+// sent to the rest of them and an error with all the failures is returned.
+func (cluster *cluster) SendBuffer(buffer *bytes.Buffer) (int, error) {
+	return cluster.SendBufferContext(context.Background(), buffer)
+}
+
+// SendBufferContext splits the buffer between the destinations like SendBuffer, honouring the
+// cancellation and deadline of the context.
+func (cluster *cluster) SendBufferContext(ctx context.Context, buffer *bytes.Buffer) (int, error) {
+	if len(cluster.keys) == 0 {
+		return 0, fmt.Errorf("There are no destinations configured in the cluster")
+	}
+	buffers := map[string]*bytes.Buffer{}
+	for _, line := range strings.Split(buffer.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		for _, key := range cluster.ring.getNodes(fields[0], cluster.config.getReplicationFactor()) {
+			if buffers[key] == nil {
+				buffers[key] = bytes.NewBufferString("")
+			}
+			buffers[key].WriteString(line + "\n")
+		}
+	}
+	total := 0
+	errors := []string{}
+	for _, key := range cluster.keys {
+		if buffers[key] == nil {
+			continue
+		}
+		n, err := cluster.clients[key].SendBufferContext(ctx, buffers[key])
+		total += n
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %s", key, err.Error()))
+		}
+	}
+	if len(errors) > 0 {
+		return total, fmt.Errorf("Unable to send metrics to some destinations: %s", strings.Join(errors, "; "))
+	}
+	return total, nil
+}
+
+// each executes the action in all the clients of the cluster, returning an error
+// containing all the failures, if any.
+func (cluster *cluster) each(action func(Graphite) error) error {
+	errors := []string{}
+	for _, key := range cluster.keys {
+		if err := action(cluster.clients[key]); err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %s", key, err.Error()))
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+	return nil
+}
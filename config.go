@@ -1,13 +1,23 @@
 package graphite
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"strings"
 	"time"
 )
 
 const (
 	// DefaultTimeout specifies the default timeout to use when connecting to graphite.
 	DefaultTimeout = 1 * time.Second
+	// DefaultMaxPacketSize specifies the default maximum payload of each UDP datagram. It's safe for
+	// a 1500 bytes MTU, leaving room for the IP and UDP headers.
+	DefaultMaxPacketSize = 1432
+	// DefaultFailbackInterval specifies how often a failover client probes the endpoints with
+	// higher priority than the active one.
+	DefaultFailbackInterval = 30 * time.Second
 )
 
 // Config stores the configuration to pass to the graphite client.
@@ -17,9 +27,15 @@ type Config struct {
 	Host string
 	// Port is an integer specifying the port where graphite is listening. This field is required.
 	Port int
+	// Socket is the path to the unix domain socket where graphite or a relay is listening. This
+	// field is required when using the unix protocols, replacing Host and Port.
+	Socket string
 	// Namespace specifies a prefix to use for all the metrics, so we don't need to set it
 	// every time we want to send something.
 	Namespace string
+	// Tags specifies the tags added by default to all the metrics, using the graphite 1.1 tagged
+	// series format. The tags specified when sending each metric take precedence over these ones.
+	Tags map[string]string
 	// Timeout specifies a new timeout in time.Duration format in case we want to increase/decrease
 	// the default one. Defaults to 1 second.
 	Timeout time.Duration
@@ -27,13 +43,174 @@ type Config struct {
 	// to graphite. This is useful when working with AWS ELB or any other network components that might
 	// be tampering with the connections.
 	ForceReconnect bool
+	// ReplicationFactor specifies to how many destinations each metric is sent when using a cluster
+	// client. Defaults to 1.
+	ReplicationFactor int
+	// FailbackInterval specifies how often a failover client probes the endpoints with higher
+	// priority than the active one, to fail back to them. Defaults to 30 seconds.
+	FailbackInterval time.Duration
+	// QueueSize specifies the maximum amount of metric lines an asynchronous client keeps in
+	// memory waiting to be sent. Defaults to 10000.
+	QueueSize int
+	// QueueOverflow specifies what an asynchronous client does when its queue is full. Defaults
+	// to OverflowDropNewest.
+	QueueOverflow OverflowPolicy
+	// QueueTimeout specifies how long an asynchronous client using OverflowBlock waits for room
+	// in the queue. Defaults to 1 second.
+	QueueTimeout time.Duration
+	// SpoolDir specifies a directory where the aggregators persist the metrics they couldn't send,
+	// even after retrying, to replay them in order once graphite is reachable again. If it's not set
+	// the metrics are only kept in memory.
+	SpoolDir string
+	// SpoolMaxSize specifies the maximum size in bytes of the spool. When exceeded the oldest
+	// metrics are discarded. Defaults to 100MB.
+	SpoolMaxSize int64
+	// SpoolSegmentSize specifies the maximum size in bytes of each one of the files of the spool.
+	// Defaults to 1MB.
+	SpoolSegmentSize int64
+	// MaxPacketSize specifies the maximum size in bytes of each datagram sent when using UDP. The
+	// buffers bigger than this will be split in several datagrams, never splitting a metric line.
+	// Defaults to DefaultMaxPacketSize.
+	MaxPacketSize int
+	// Precision specifies the number of decimals of the values sent by the metrics of the
+	// aggregator. Defaults to DefaultPrecision, use PrecisionNone to send them without decimals.
+	Precision int
+	// DurationUnit specifies the unit the durations received by the aggregator are converted
+	// to before sending them. Defaults to DefaultDurationUnit, milliseconds.
+	DurationUnit time.Duration
+	// GaugeTTL specifies how long the metrics retained between flushes, like the gauges, are kept
+	// without being updated before being discarded. By default they are kept until removed.
+	GaugeTTL time.Duration
+	// Alignment specifies how the aggregator aligns the timestamps of the metrics, so the metrics
+	// sent by several instances land in the same bucket of the retention. By default the metrics
+	// are sent with the timestamp of the flush.
+	Alignment Alignment
+	// AlignmentInterval specifies the interval to align the timestamps to. Defaults to the period
+	// used with `Run`, or no alignment if the aggregator is flushed manually.
+	AlignmentInterval time.Duration
+	// StorageSchemas specifies the storage schemas of carbon, loaded with LoadStorageSchemas. When
+	// aligning the timestamps, the precision of the finest retention of the first schema matching
+	// each metric is used as interval, instead of AlignmentInterval.
+	StorageSchemas StorageSchemas
+	// SketchAccuracy specifies the relative accuracy of the percentiles of the sketch metrics
+	// created by the aggregator. Defaults to DefaultSketchAccuracy.
+	SketchAccuracy float64
+	// SketchMaxBins specifies the maximum number of bins of the sketch metrics created by the
+	// aggregator, bounding the memory used by each one of them. Defaults to DefaultSketchMaxBins.
+	SketchMaxBins int
+	// UniqueBits specifies the number of bits used to index the registers of the unique metrics
+	// created by the aggregator, trading memory for accuracy. Defaults to DefaultUniqueBits.
+	UniqueBits uint8
+	// BackfillChunkSize specifies the maximum number of points sent in each write by SendPoints.
+	// Defaults to DefaultBackfillChunkSize.
+	BackfillChunkSize int
+	// BackfillRate specifies the maximum number of points per second sent by SendPoints, so big
+	// backfills don't overwhelm carbon. By default there is no limit.
+	BackfillRate int
+	// Sanitize specifies what to do with the metric paths containing characters that would corrupt
+	// the plaintext protocol, like whitespaces, newlines or empty nodes. By default the paths are
+	// sent as they are, use ValidatePath to check the paths built from user input.
+	Sanitize SanitizePolicy
+	// SanitizeTags specifies what to do with the tags containing characters not allowed by graphite.
+	// By default these characters are replaced.
+	SanitizeTags SanitizePolicy
+	// Reconnect specifies the policy to apply when the connection with graphite fails, backing off
+	// exponentially and opening a circuit breaker to fail fast. If it's not set, the client tries to
+	// connect every time it needs to.
+	Reconnect *ReconnectPolicy
+	// TLS specifies the configuration to use when connecting to graphite through TLS. If it's
+	// not set the TCP based protocols will send the metrics in plain text.
+	TLS *TLSConfig
 }
 
-func (config *Config) getMetricPath(metricPath string) string {
+// TLSConfig stores the configuration to secure the TCP connections with graphite, or with
+// any TLS-terminating relay placed in front of it.
+type TLSConfig struct {
+	// CAFile is the path to a PEM file containing the root certificates used to verify the server.
+	// If it's not set the system root certificates will be used.
+	CAFile string
+	// CertFile is the path to a PEM file containing the client certificate, in case the server
+	// requires client authentication. It must be set together with KeyFile.
+	CertFile string
+	// KeyFile is the path to a PEM file containing the private key of the client certificate.
+	KeyFile string
+	// ServerName is used to verify the hostname of the server certificate and it's sent through SNI.
+	// Defaults to the host specified in the configuration.
+	ServerName string
+	// MinVersion specifies the minimum TLS version accepted, using the constants of crypto/tls.
+	// Defaults to tls.VersionTLS12.
+	MinVersion uint16
+	// InsecureSkipVerify disables the verification of the server certificate. Use only for testing.
+	InsecureSkipVerify bool
+}
+
+func (config *TLSConfig) build(host string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if config.ServerName != "" {
+		tlsConfig.ServerName = config.ServerName
+	}
+	if config.MinVersion != 0 {
+		tlsConfig.MinVersion = config.MinVersion
+	}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read the CA file: %s", err.Error())
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Unable to find any certificate in the CA file %s", config.CAFile)
+		}
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load the client certificate: %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+func (config *Config) getMetricPath(metricPath string) (string, error) {
+	return config.getSeriesPath(metricPath, nil)
+}
+
+// getSeriesPath returns the full identity of a series: the path with the namespace and all its tags
+// (default, inline and the ones received) in canonical order.
+func (config *Config) getSeriesPath(metricPath string, tags map[string]string) (string, error) {
 	if config.Namespace != "" && metricPath != "" {
-		return fmt.Sprintf("%s.%s", config.Namespace, metricPath)
+		return config.getTaggedPath(fmt.Sprintf("%s.%s", config.Namespace, metricPath), tags)
 	}
-	return config.Namespace + metricPath
+	return config.getTaggedPath(config.Namespace+metricPath, tags)
+}
+
+// getTaggedPath returns the path with the default tags and the ones received, in canonical order,
+// sanitized following the policies of the configuration. The paths without tags are returned as
+// they are unless a policy is set for them.
+func (config *Config) getTaggedPath(metricPath string, tags map[string]string) (string, error) {
+	if len(config.Tags) == 0 && len(tags) == 0 && !strings.Contains(metricPath, tagSeparator) {
+		return sanitizeName(metricPath, config.Sanitize)
+	}
+	if config.SanitizeTags == SanitizeReject {
+		if err := validateSeriesTags(metricPath); err != nil {
+			return "", err
+		}
+	}
+	name, inline := parseSeries(metricPath)
+	name, err := sanitizeName(name, config.Sanitize)
+	if err != nil {
+		return "", err
+	}
+	merged, err := sanitizeTags(mergeTags(config.Tags, inline, tags), config.SanitizeTags)
+	if err != nil {
+		return "", err
+	}
+	return formatSeries(name, merged), nil
 }
 
 func (config *Config) getAddress() string {
@@ -46,3 +223,66 @@ func (config *Config) getTimeout() time.Duration {
 	}
 	return DefaultTimeout
 }
+
+func (config *Config) getReplicationFactor() int {
+	if config.ReplicationFactor > 0 {
+		return config.ReplicationFactor
+	}
+	return 1
+}
+
+func (config *Config) getFailbackInterval() time.Duration {
+	if config.FailbackInterval > 0 {
+		return config.FailbackInterval
+	}
+	return DefaultFailbackInterval
+}
+
+func (config *Config) getQueueSize() int {
+	if config.QueueSize > 0 {
+		return config.QueueSize
+	}
+	return DefaultQueueSize
+}
+
+func (config *Config) getQueueTimeout() time.Duration {
+	if config.QueueTimeout > 0 {
+		return config.QueueTimeout
+	}
+	return DefaultQueueTimeout
+}
+
+func (config *Config) getSpoolMaxSize() int64 {
+	if config.SpoolMaxSize > 0 {
+		return config.SpoolMaxSize
+	}
+	return DefaultSpoolMaxSize
+}
+
+func (config *Config) getSpoolSegmentSize() int64 {
+	if config.SpoolSegmentSize > 0 {
+		return config.SpoolSegmentSize
+	}
+	return DefaultSpoolSegmentSize
+}
+
+func (config *Config) getMaxPacketSize() int {
+	if config.MaxPacketSize > 0 {
+		return config.MaxPacketSize
+	}
+	return DefaultMaxPacketSize
+}
+
+func (config *Config) getDurationUnit() time.Duration {
+	if config.DurationUnit > 0 {
+		return config.DurationUnit
+	}
+	return DefaultDurationUnit
+}
+
+func (config *Config) getBackfillChunkSize() int {
+	if config.BackfillChunkSize > 0 {
+		return config.BackfillChunkSize
+	}
+	return DefaultBackfillChunkSize
+}
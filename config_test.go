@@ -1,9 +1,11 @@
 package graphite
 
 import (
+	"crypto/tls"
+	"time"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
-	"time"
 )
 
 var _ = Describe("configuration", func() {
@@ -40,6 +42,92 @@ var _ = Describe("configuration", func() {
 		})
 	})
 
+	Context("tagged series path", func() {
+
+		BeforeEach(func() {
+			config = Config{
+				Namespace: "alpha",
+				Tags:      map[string]string{"dc": "eu", "env": "prod"},
+			}
+		})
+
+		It("adds the namespace and the default tags in canonical order", func() {
+			Expect(config.getMetricPath("cpu")).To(Equal("alpha.cpu;dc=eu;env=prod"))
+		})
+
+		It("merges the inline tags and the tags received with the default ones", func() {
+			Expect(config.getSeriesPath("cpu;host=web1;env=dev", map[string]string{"host": "web2"})).To(Equal("alpha.cpu;dc=eu;env=dev;host=web2"))
+		})
+
+		It("keeps the paths without tags untouched", func() {
+			config.Tags = nil
+			Expect(config.getTaggedPath("cpu.usage", nil)).To(Equal("cpu.usage"))
+		})
+
+		It("canonicalises the inline tags of the paths", func() {
+			config.Tags = nil
+			Expect(config.getTaggedPath("cpu;host=web1;dc=eu", nil)).To(Equal("cpu;dc=eu;host=web1"))
+		})
+	})
+
+	Context("sanitized path", func() {
+
+		BeforeEach(func() {
+			config = Config{
+				Namespace: "alpha",
+			}
+		})
+
+		It("sends the paths as they are by default", func() {
+			Expect(config.getMetricPath("cpu..usage host")).To(Equal("alpha.cpu..usage host"))
+		})
+
+		It("replaces the characters not allowed and removes the empty nodes", func() {
+			config.Sanitize = SanitizeReplace
+			Expect(config.getMetricPath("cpu..usage host\n.")).To(Equal("alpha.cpu.usage_host_"))
+		})
+
+		It("strips the characters not allowed and removes the empty nodes", func() {
+			config.Sanitize = SanitizeStrip
+			Expect(config.getMetricPath(".cpu..usage\tcafé")).To(Equal("alpha.cpu.usagecaf"))
+		})
+
+		It("rejects the paths with characters not allowed", func() {
+			config.Sanitize = SanitizeReject
+			_, err := config.getMetricPath("cpu usage")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("accepts the valid paths when rejecting", func() {
+			config.Sanitize = SanitizeReject
+			Expect(config.getSeriesPath("cpu.usage", map[string]string{"host": "web 1"})).To(Equal("alpha.cpu.usage;host=web_1"))
+		})
+
+		It("returns an error if nothing is left after sanitizing the path", func() {
+			config.Namespace = ""
+			config.Sanitize = SanitizeStrip
+			_, err := config.getMetricPath(". ..")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("strips the characters not allowed in the tags", func() {
+			config.SanitizeTags = SanitizeStrip
+			Expect(config.getSeriesPath("cpu", map[string]string{"ho st": "~web;1"})).To(Equal("alpha.cpu;host=web1"))
+		})
+
+		It("rejects the tags with characters not allowed", func() {
+			config.SanitizeTags = SanitizeReject
+			_, err := config.getSeriesPath("cpu", map[string]string{"host": "web 1"})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("rejects the malformed inline tags", func() {
+			config.SanitizeTags = SanitizeReject
+			_, err := config.getSeriesPath("cpu;host", nil)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
 	Context("graphite address", func() {
 
 		BeforeEach(func() {
@@ -79,4 +167,85 @@ var _ = Describe("configuration", func() {
 			Expect(config.getTimeout()).To(Equal(config.Timeout))
 		})
 	})
+
+	Context("failback interval", func() {
+
+		BeforeEach(func() {
+			config = Config{}
+		})
+
+		It("returns a default interval of 30 seconds if none is provided", func() {
+			Expect(config.getFailbackInterval()).To(Equal(30 * time.Second))
+		})
+
+		It("returns the interval set as time duration", func() {
+			config.FailbackInterval = 5 * time.Second
+			Expect(config.getFailbackInterval()).To(Equal(config.FailbackInterval))
+		})
+	})
+
+	Context("duration unit", func() {
+
+		BeforeEach(func() {
+			config = Config{}
+		})
+
+		It("returns milliseconds by default", func() {
+			Expect(config.getDurationUnit()).To(Equal(time.Millisecond))
+		})
+
+		It("returns the unit set", func() {
+			config.DurationUnit = time.Second
+			Expect(config.getDurationUnit()).To(Equal(time.Second))
+		})
+	})
+
+	Context("udp packet size", func() {
+
+		BeforeEach(func() {
+			config = Config{}
+		})
+
+		It("returns a default size safe for a 1500 bytes MTU if none is provided", func() {
+			Expect(config.getMaxPacketSize()).To(Equal(DefaultMaxPacketSize))
+			Expect(config.getMaxPacketSize()).To(BeNumerically("<=", 1500-28))
+		})
+
+		It("returns the size set in the configuration", func() {
+			config.MaxPacketSize = 512
+			Expect(config.getMaxPacketSize()).To(Equal(512))
+		})
+	})
+
+	Context("tls configuration", func() {
+
+		It("uses the host as server name and TLS 1.2 as minimum version by default", func() {
+			tlsConfig, err := (&TLSConfig{}).build("example.com")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tlsConfig.ServerName).To(Equal("example.com"))
+			Expect(tlsConfig.MinVersion).To(Equal(uint16(tls.VersionTLS12)))
+			Expect(tlsConfig.RootCAs).To(BeNil())
+			Expect(tlsConfig.Certificates).To(BeEmpty())
+		})
+
+		It("overrides the server name and minimum version if set", func() {
+			tlsConfig, err := (&TLSConfig{
+				ServerName: "graphite.local",
+				MinVersion: tls.VersionTLS11,
+			}).build("example.com")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tlsConfig.ServerName).To(Equal("graphite.local"))
+			Expect(tlsConfig.MinVersion).To(Equal(uint16(tls.VersionTLS11)))
+		})
+
+		It("returns an error if the CA file doesn't exist", func() {
+			_, err := (&TLSConfig{CAFile: "unknown.pem"}).build("example.com")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error if only one of the client certificate files is set", func() {
+			_, err := (&TLSConfig{KeyFile: "unknown.key"}).build("example.com")
+			Expect(err).To(HaveOccurred())
+		})
+	})
 })
@@ -0,0 +1,204 @@
+package graphite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+type failover struct {
+	config    *Config
+	clients   []Graphite
+	names     []string
+	active    int
+	lastProbe time.Time
+	mutex     sync.Mutex
+}
+
+// NewGraphiteFailover creates a new graphite client that sends the metrics to the first endpoint
+// available, in order of priority. When the active endpoint fails the client fails over to the
+// next one, periodically probing the higher priority endpoints to fail back as soon as they recover.
+// The probing period is taken from the FailbackInterval of the first configuration.
+//
+//         import graphite "github.com/gguridi/graphite-client"
+//
+//         client := graphite.NewGraphiteFailover(graphite.ProtocolTCP,
+//             &graphite.Config{Host: "primary.example.com", Port: 2003},
+//             &graphite.Config{Host: "secondary.example.com", Port: 2003},
+//         )
+func NewGraphiteFailover(protocol string, configs ...*Config) Graphite {
+	failover := &failover{config: &Config{}}
+	if len(configs) > 0 {
+		failover.config = configs[0]
+	}
+	for _, config := range configs {
+		failover.clients = append(failover.clients, newGraphite(config, protocol))
+		failover.names = append(failover.names, config.getAddress())
+	}
+	return failover
+}
+
+// Connect establishes a connection with the first endpoint available, in order of priority.
+func (failover *failover) Connect() error {
+	return failover.ConnectContext(context.Background())
+}
+
+// ConnectContext establishes a connection with the first endpoint available like Connect,
+// honouring the cancellation and deadline of the context.
+func (failover *failover) ConnectContext(ctx context.Context) error {
+	return failover.connect(ctx, func(client Graphite) error {
+		return client.ConnectContext(ctx)
+	})
+}
+
+// Reconnect tries to close the previous connection and reconnect with the first endpoint
+// available, in order of priority.
+func (failover *failover) Reconnect() error {
+	return failover.connect(context.Background(), func(client Graphite) error {
+		return client.Reconnect()
+	})
+}
+
+// Disconnect tries to close the connections with all the endpoints.
+func (failover *failover) Disconnect() error {
+	failover.mutex.Lock()
+	defer failover.mutex.Unlock()
+	errors := []string{}
+	for i, client := range failover.clients {
+		if err := client.Disconnect(); err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %s", failover.names[i], err.Error()))
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+// NewAggregator returns a new aggregator that will use the failover client.
+func (failover *failover) NewAggregator() Aggregator {
+	return newAggregator(failover.config, failover)
+}
+
+// Send is used to immediately send a metric to the active endpoint.
+func (failover *failover) Send(path, value string) (int, error) {
+	return failover.SendContext(context.Background(), path, value)
+}
+
+// SendContext is used to immediately send a metric like Send, honouring the cancellation and
+// deadline of the context.
+func (failover *failover) SendContext(ctx context.Context, path, value string) (int, error) {
+	return sendMetric(ctx, failover, failover.config, path, nil, value, time.Now())
+}
+
+// SendTagged is used to send a metric like Send, using the graphite 1.1 tagged series format.
+func (failover *failover) SendTagged(path string, tags map[string]string, value string) (int, error) {
+	return sendMetric(context.Background(), failover, failover.config, path, tags, value, time.Now())
+}
+
+// SendAt is used to send a metric like Send, with the timestamp received instead of the current time.
+func (failover *failover) SendAt(path string, value string, timestamp time.Time) (int, error) {
+	return failover.SendAtContext(context.Background(), path, value, timestamp)
+}
+
+// SendAtContext is used to send a metric like SendAt, honouring the cancellation and deadline
+// of the context.
+func (failover *failover) SendAtContext(ctx context.Context, path string, value string, timestamp time.Time) (int, error) {
+	return sendMetric(ctx, failover, failover.config, path, nil, value, timestamp)
+}
+
+// SendPoints is used to send a batch of points, each one of them with its own timestamp, in
+// chunks of `BackfillChunkSize` and not exceeding the `BackfillRate` of the configuration.
+func (failover *failover) SendPoints(points []Point) (int, error) {
+	return failover.SendPointsContext(context.Background(), points)
+}
+
+// SendPointsContext is used to send a batch of points like SendPoints, honouring the cancellation
+// and deadline of the context.
+func (failover *failover) SendPointsContext(ctx context.Context, points []Point) (int, error) {
+	return sendPoints(ctx, failover, failover.config, points)
+}
+
+// SendBuffer sends the buffer to the active endpoint, failing over to the next ones in order
+// of priority if it can't. An error is only returned if none of the endpoints accepted it.
+func (failover *failover) SendBuffer(buffer *bytes.Buffer) (int, error) {
+	return failover.SendBufferContext(context.Background(), buffer)
+}
+
+// SendBufferContext sends the buffer failing over between the endpoints like SendBuffer,
+// honouring the cancellation and deadline of the context.
+func (failover *failover) SendBufferContext(ctx context.Context, buffer *bytes.Buffer) (int, error) {
+	failover.mutex.Lock()
+	defer failover.mutex.Unlock()
+	failover.probe(ctx)
+	return failover.try(ctx, func(client Graphite) (int, error) {
+		return client.SendBufferContext(ctx, buffer)
+	})
+}
+
+func (failover *failover) connect(ctx context.Context, action func(Graphite) error) error {
+	failover.mutex.Lock()
+	defer failover.mutex.Unlock()
+	_, err := failover.try(ctx, func(client Graphite) (int, error) {
+		return 0, action(client)
+	})
+	return err
+}
+
+// try executes the action starting from the active endpoint and continuing with the next ones,
+// wrapping around to the ones with higher priority, until one of them succeeds, which becomes
+// the active one. The cancellation of the context is not a failure of the endpoints, so it stops
+// trying without disconnecting them.
+func (failover *failover) try(ctx context.Context, action func(Graphite) (int, error)) (int, error) {
+	if len(failover.clients) == 0 {
+		return 0, fmt.Errorf("There are no endpoints configured to fail over")
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	errors := []string{}
+	for offset := 0; offset < len(failover.clients); offset++ {
+		i := (failover.active + offset) % len(failover.clients)
+		n, err := action(failover.clients[i])
+		if err == nil {
+			failover.activate(i)
+			return n, nil
+		}
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		failover.clients[i].Disconnect()
+		errors = append(errors, fmt.Sprintf("%s: %s", failover.names[i], err.Error()))
+	}
+	return 0, fmt.Errorf("All the endpoints failed: %s", strings.Join(errors, "; "))
+}
+
+// probe tries to reconnect with the endpoints with higher priority than the active one,
+// if the failback interval has passed since the last time they were probed. The probing is
+// bounded by the context of the operation triggering it.
+func (failover *failover) probe(ctx context.Context) {
+	if failover.active == 0 || time.Since(failover.lastProbe) < failover.config.getFailbackInterval() {
+		return
+	}
+	failover.lastProbe = time.Now()
+	for i := 0; i < failover.active && ctx.Err() == nil; i++ {
+		failover.clients[i].Disconnect()
+		if err := failover.clients[i].ConnectContext(ctx); err == nil {
+			failover.clients[failover.active].Disconnect()
+			failover.activate(i)
+			return
+		}
+	}
+}
+
+func (failover *failover) activate(index int) {
+	if index != failover.active {
+		log.Printf("Graphite: failing over from %s to %s\n", failover.names[failover.active], failover.names[index])
+		failover.active = index
+		failover.lastProbe = time.Now()
+	}
+}
@@ -0,0 +1,118 @@
+package graphite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("failover between endpoints", func() {
+
+	var (
+		disconnected []string
+		sent         []string
+		client       *failover
+	)
+
+	newEndpoint := func(name string, sendErr error) *MockGraphite {
+		return &MockGraphite{
+			MethodSendBufferContext: func(m *MockGraphite, ctx context.Context, buffer *bytes.Buffer) (int, error) {
+				if err := ctx.Err(); err != nil {
+					return 0, err
+				}
+				if sendErr != nil {
+					return 0, sendErr
+				}
+				sent = append(sent, name)
+				return buffer.Len(), nil
+			},
+			MethodDisconnect: func(m *MockGraphite) error {
+				disconnected = append(disconnected, name)
+				return nil
+			},
+		}
+	}
+
+	BeforeEach(func() {
+		disconnected = []string{}
+		sent = []string{}
+		client = &failover{
+			config:  &Config{},
+			clients: []Graphite{newEndpoint("primary", nil), newEndpoint("secondary", nil)},
+			names:   []string{"primary", "secondary"},
+		}
+	})
+
+	It("fails over to the next endpoint disconnecting the one failing", func() {
+		client.clients[0] = newEndpoint("primary", fmt.Errorf("Broken pipe"))
+		_, err := client.SendBuffer(bytes.NewBufferString("metricA 10 1500000000\n"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sent).To(Equal([]string{"secondary"}))
+		Expect(disconnected).To(Equal([]string{"primary"}))
+		Expect(client.active).To(Equal(1))
+	})
+
+	It("doesn't disconnect nor fail over the endpoints if the context is cancelled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := client.SendBufferContext(ctx, bytes.NewBufferString("metricA 10 1500000000\n"))
+		Expect(err).To(Equal(context.Canceled))
+		Expect(sent).To(BeEmpty())
+		Expect(disconnected).To(BeEmpty())
+		Expect(client.active).To(Equal(0))
+	})
+
+	It("stops failing over if the context is cancelled while sending", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		client.clients[0] = &MockGraphite{
+			MethodSendBufferContext: func(m *MockGraphite, ctx context.Context, buffer *bytes.Buffer) (int, error) {
+				cancel()
+				return 0, ctx.Err()
+			},
+		}
+		_, err := client.SendBufferContext(ctx, bytes.NewBufferString("metricA 10 1500000000\n"))
+		Expect(err).To(Equal(context.Canceled))
+		Expect(sent).To(BeEmpty())
+		Expect(disconnected).To(BeEmpty())
+		Expect(client.active).To(Equal(0))
+	})
+
+	It("probes the endpoints with higher priority with the context of the operation", func() {
+		var probed context.Context
+		client.clients[0] = &MockGraphite{
+			Data: map[string]string{},
+			MethodConnectContext: func(m *MockGraphite, ctx context.Context) error {
+				probed = ctx
+				return nil
+			},
+		}
+		client.active = 1
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := client.SendBufferContext(ctx, bytes.NewBufferString("metricA 10 1500000000\n"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(probed).To(BeIdenticalTo(ctx))
+		Expect(client.active).To(Equal(0))
+	})
+
+	It("doesn't block the operation longer than its deadline while probing", func() {
+		client.clients[0] = &MockGraphite{
+			MethodConnectContext: func(m *MockGraphite, ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+		}
+		client.active = 1
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := client.SendBufferContext(ctx, bytes.NewBufferString("metricA 10 1500000000\n"))
+		Expect(err).To(Equal(context.DeadlineExceeded))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		Expect(client.active).To(Equal(1))
+	})
+})
@@ -2,6 +2,8 @@ package graphite
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
@@ -13,28 +15,48 @@ const (
 	ProtocolTCP = "tcp"
 	// ProtocolUDP is a constant to specify the protocol UDP
 	ProtocolUDP = "udp"
+	// ProtocolPickle is a constant to specify the pickle protocol over TCP
+	ProtocolPickle = "pickle"
+	// ProtocolUnix is a constant to specify the protocol over a stream unix domain socket
+	ProtocolUnix = "unix"
+	// ProtocolUnixgram is a constant to specify the protocol over a datagram unix domain socket
+	ProtocolUnixgram = "unixgram"
 )
 
 // Graphite is an interface for a graphite client
 type Graphite interface {
 	Send(string, string) (int, error)
+	SendContext(context.Context, string, string) (int, error)
+	SendTagged(string, map[string]string, string) (int, error)
+	SendAt(string, string, time.Time) (int, error)
+	SendAtContext(context.Context, string, string, time.Time) (int, error)
+	SendPoints([]Point) (int, error)
+	SendPointsContext(context.Context, []Point) (int, error)
 	SendBuffer(*bytes.Buffer) (int, error)
+	SendBufferContext(context.Context, *bytes.Buffer) (int, error)
 	NewAggregator() Aggregator
 	Connect() error
+	ConnectContext(context.Context) error
 	Reconnect() error
 	Disconnect() error
 }
 
 type graphite struct {
-	config     *Config
-	protocol   string
-	connection net.Conn
+	config      *Config
+	protocol    string
+	connection  net.Conn
+	reconnector *reconnector
 }
 
 func newGraphite(config *Config, protocol string) Graphite {
+	address := config.getAddress()
+	if protocol == ProtocolUnix || protocol == ProtocolUnixgram {
+		address = config.Socket
+	}
 	return &graphite{
-		config:   config,
-		protocol: protocol,
+		config:      config,
+		protocol:    protocol,
+		reconnector: newReconnector(config.Reconnect, address),
 	}
 }
 
@@ -48,19 +70,55 @@ func NewGraphiteUDP(config *Config) Graphite {
 	return newGraphite(config, ProtocolUDP)
 }
 
+// NewGraphitePickle creates a new graphite client based on the carbon pickle protocol over TCP.
+// Graphite usually listens to this protocol in the port 2004.
+func NewGraphitePickle(config *Config) Graphite {
+	return newGraphite(config, ProtocolPickle)
+}
+
+// NewGraphiteUnix creates a new graphite client based on a stream unix domain socket. The path
+// to the socket must be set through the Socket field of the configuration.
+func NewGraphiteUnix(config *Config) Graphite {
+	return newGraphite(config, ProtocolUnix)
+}
+
+// NewGraphiteUnixgram creates a new graphite client based on a datagram unix domain socket. The path
+// to the socket must be set through the Socket field of the configuration.
+func NewGraphiteUnixgram(config *Config) Graphite {
+	return newGraphite(config, ProtocolUnixgram)
+}
+
 // Connect establishes a connection with the graphite server, returning an error if something happened.
+// If a reconnect policy is configured and the previous attempts failed, it returns a *BackoffError or
+// a *CircuitOpenError without trying to connect until the policy allows it.
 func (graphite *graphite) Connect() error {
-	connection, err := graphite.connect(graphite.protocol)
-	if err == nil {
-		graphite.connection = connection
+	return graphite.ConnectContext(context.Background())
+}
+
+// ConnectContext establishes a connection with the graphite server like Connect, but the dialing
+// is aborted if the context is cancelled or its deadline is exceeded before finishing.
+func (graphite *graphite) ConnectContext(ctx context.Context) error {
+	if err := graphite.reconnector.allow(); err != nil {
+		return err
 	}
-	return err
+	connection, err := graphite.connect(ctx, graphite.protocol)
+	if err != nil {
+		graphite.reconnector.failure()
+		return contextError(ctx, err)
+	}
+	graphite.reconnector.success()
+	graphite.connection = connection
+	return nil
 }
 
 // Reconnect tries to close a previous connection and reconnect with the graphite server.
 func (graphite *graphite) Reconnect() error {
+	return graphite.reconnect(context.Background())
+}
+
+func (graphite *graphite) reconnect(ctx context.Context) error {
 	graphite.Disconnect()
-	return graphite.Connect()
+	return graphite.ConnectContext(ctx)
 }
 
 // Disconnect tries to close a previous connection, returning an error if it can't.
@@ -75,16 +133,15 @@ func (graphite *graphite) Disconnect() error {
 
 // NewAggregator returns a new aggregator that will use the created client.
 func (graphite *graphite) NewAggregator() Aggregator {
-	return &aggregator{
-		config:  graphite.config,
-		client:  graphite,
-		metrics: map[string]Metric{},
-	}
+	return newAggregator(graphite.config, graphite)
 }
 
-func (graphite *graphite) getConnection() (net.Conn, error) {
+func (graphite *graphite) getConnection(ctx context.Context) (net.Conn, error) {
 	if graphite.config.ForceReconnect || graphite.connection == nil {
-		if err := graphite.Reconnect(); err != nil {
+		if err := graphite.reconnect(ctx); err != nil {
+			if isReconnectPolicyError(err) || err == ctx.Err() {
+				return nil, err
+			}
 			return nil, fmt.Errorf("Unable to connect/reconnect before sending metrics: %s", err.Error())
 		}
 	}
@@ -102,11 +159,67 @@ func (graphite *graphite) getConnection() (net.Conn, error) {
 //         })
 //         client.Send("files.processed.count", 15)
 func (graphite *graphite) Send(path, value string) (int, error) {
-	metric := graphite.format(path, value, time.Now().Unix())
-	return graphite.SendBuffer(bytes.NewBufferString(metric))
+	return graphite.SendContext(context.Background(), path, value)
+}
+
+// SendContext is used to immediately send a metric to graphite like Send, but connecting and
+// writing are aborted if the context is cancelled or its deadline is exceeded.
+func (graphite *graphite) SendContext(ctx context.Context, path, value string) (int, error) {
+	return sendMetric(ctx, graphite, graphite.config, path, nil, value, time.Now())
+}
+
+// SendTagged is used to immediately send a metric to graphite like Send, using the graphite 1.1
+// tagged series format. The tags are merged with the default ones of the configuration.
+//
+//         client.SendTagged("cpu.usage", map[string]string{"host": "web1", "dc": "eu"}, "55")
+func (graphite *graphite) SendTagged(path string, tags map[string]string, value string) (int, error) {
+	return sendMetric(context.Background(), graphite, graphite.config, path, tags, value, time.Now())
+}
+
+// SendAt is used to immediately send a metric to graphite like Send, with the timestamp received
+// instead of the current time. Useful to send historical data.
+//
+//         client.SendAt("files.processed.count", "15", time.Date(2019, 4, 11, 0, 0, 0, 0, time.UTC))
+func (graphite *graphite) SendAt(path string, value string, timestamp time.Time) (int, error) {
+	return graphite.SendAtContext(context.Background(), path, value, timestamp)
+}
+
+// SendAtContext is used to send a metric like SendAt, honouring the cancellation and deadline
+// of the context.
+func (graphite *graphite) SendAtContext(ctx context.Context, path string, value string, timestamp time.Time) (int, error) {
+	return sendMetric(ctx, graphite, graphite.config, path, nil, value, timestamp)
+}
+
+// SendPoints is used to send a batch of points to graphite, each one of them with its own timestamp,
+// like when backfilling historical data. The points are sent in chunks of `BackfillChunkSize`,
+// waiting between them if needed to not exceed the `BackfillRate` of the configuration.
+//
+//         client.SendPoints([]graphite.Point{
+//             {Path: "jobs.processed", Value: 15, Timestamp: yesterday},
+//             {Path: "jobs.processed", Value: 10, Timestamp: today, Tags: map[string]string{"queue": "high"}},
+//         })
+func (graphite *graphite) SendPoints(points []Point) (int, error) {
+	return graphite.SendPointsContext(context.Background(), points)
 }
 
-func (graphite *graphite) format(path string, value string, timestamp int64) string {
+// SendPointsContext is used to send a batch of points like SendPoints, but sending and waiting
+// between the chunks are aborted if the context is cancelled or its deadline is exceeded.
+func (graphite *graphite) SendPointsContext(ctx context.Context, points []Point) (int, error) {
+	return sendPoints(ctx, graphite, graphite.config, points)
+}
+
+// sendMetric sends a single metric through the client, with its path and tags formatted following
+// the configuration. It's shared by all the clients to implement their Send methods.
+func sendMetric(ctx context.Context, client Graphite, config *Config, path string, tags map[string]string, value string, timestamp time.Time) (int, error) {
+	series, err := config.getTaggedPath(path, tags)
+	if err != nil {
+		return 0, err
+	}
+	return client.SendBufferContext(ctx, bytes.NewBufferString(format(series, value, timestamp.Unix())))
+}
+
+// format returns the line representing a metric in the plaintext protocol.
+func format(path string, value string, timestamp int64) string {
 	return fmt.Sprintf("%s %s %d\n", path, value, timestamp)
 }
 
@@ -123,35 +236,182 @@ func (graphite *graphite) format(path string, value string, timestamp int64) str
 //             files.processed.count 15 1554992147
 //             files.unprocessed.count 35 1554992147
 //         `))
+//
+// The buffer is always expected in the plaintext format. When using the pickle protocol the
+// metrics will be converted to pickle frames before being sent, and when using UDP the buffer
+// will be split in datagrams of up to MaxPacketSize bytes.
 func (graphite *graphite) SendBuffer(buffer *bytes.Buffer) (int, error) {
-	connection, err := graphite.getConnection()
-	if err == nil {
-		return connection.Write(buffer.Bytes())
+	return graphite.SendBufferContext(context.Background(), buffer)
+}
+
+// SendBufferContext is used to immediately send a whole buffer to graphite like SendBuffer, but
+// connecting and writing are aborted if the context is cancelled or its deadline is exceeded.
+func (graphite *graphite) SendBufferContext(ctx context.Context, buffer *bytes.Buffer) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	data := buffer.Bytes()
+	if graphite.protocol == ProtocolPickle {
+		frames, err := encodePickle(buffer)
+		if err != nil {
+			return 0, fmt.Errorf("Unable to encode metrics using pickle: %s", err.Error())
+		}
+		data = frames
+	}
+	connection, err := graphite.getConnection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer watchContext(ctx, connection)()
+	var n int
+	if graphite.protocol == ProtocolUDP {
+		n, err = graphite.writePackets(connection, data)
+	} else {
+		n, err = connection.Write(data)
+	}
+	if err != nil {
+		// A partial write leaves the connection in an unknown state, so it's discarded
+		// and a new one will be established for the next metrics.
+		graphite.Disconnect()
+		return n, contextError(ctx, err)
+	}
+	return n, nil
+}
+
+// watchContext applies the deadline of the context to the connection, and interrupts any
+// operation in progress if the context is cancelled. The returned function must be called
+// once the operations have finished to stop watching the context.
+func watchContext(ctx context.Context, connection net.Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		connection.SetDeadline(deadline)
+	}
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			connection.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-finished
+		connection.SetDeadline(time.Time{})
+	}
+}
+
+// contextError returns the error of the context if it's done. As the deadline of the context is
+// applied to the connection, the operations can time out before the context notices it, in which
+// case the deadline error is returned instead of the timeout of the connection.
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+	}
+	return err
+}
+
+// writePackets writes the data in as many datagrams as needed to not exceed the maximum packet
+// size, returning the total amount of bytes written.
+func (graphite *graphite) writePackets(connection net.Conn, data []byte) (int, error) {
+	total := 0
+	for _, packet := range splitPackets(data, graphite.config.getMaxPacketSize()) {
+		n, err := connection.Write(packet)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// splitPackets splits the data on line boundaries in chunks of up to size bytes. A line longer
+// than size is never split, being returned in a chunk by itself.
+func splitPackets(data []byte, size int) [][]byte {
+	packets := [][]byte{}
+	start, end := 0, 0
+	for end < len(data) {
+		next := bytes.IndexByte(data[end:], '\n')
+		if next < 0 {
+			next = len(data)
+		} else {
+			next += end + 1
+		}
+		if next-start > size && end > start {
+			packets = append(packets, data[start:end])
+			start = end
+		}
+		end = next
 	}
-	return 0, err
+	if end > start {
+		packets = append(packets, data[start:end])
+	}
+	return packets
 }
 
-func (graphite *graphite) connect(protocol string) (net.Conn, error) {
+func (graphite *graphite) connect(ctx context.Context, protocol string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: graphite.config.getTimeout()}
 	switch protocol {
 	case ProtocolUDP:
-		return graphite.connectUDP()
+		return graphite.connectUDP(ctx, dialer)
+	case ProtocolUnix, ProtocolUnixgram:
+		return graphite.connectUnix(ctx, dialer, protocol)
 	default:
-		return graphite.connectTCP()
+		return graphite.connectTCP(ctx, dialer)
 	}
 }
 
-func (graphite *graphite) connectTCP() (net.Conn, error) {
+func (graphite *graphite) connectTCP(ctx context.Context, dialer *net.Dialer) (net.Conn, error) {
 	address := graphite.config.getAddress()
+	if graphite.config.TLS != nil {
+		return graphite.connectTLS(ctx, dialer, address)
+	}
 	log.Printf("Graphite: connecting to %s via TCP\n", address)
-	return net.DialTimeout("tcp", address, graphite.config.getTimeout())
+	return dialer.DialContext(ctx, "tcp", address)
 }
 
-func (graphite *graphite) connectUDP() (net.Conn, error) {
+func (graphite *graphite) connectTLS(ctx context.Context, dialer *net.Dialer, address string) (net.Conn, error) {
+	tlsConfig, err := graphite.config.TLS.build(graphite.config.Host)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Graphite: connecting to %s via TLS\n", address)
+	connection, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	handshakeCtx, cancel := context.WithTimeout(ctx, dialer.Timeout)
+	defer cancel()
+	tlsConnection := tls.Client(connection, tlsConfig)
+	stop := watchContext(handshakeCtx, tlsConnection)
+	err = tlsConnection.Handshake()
+	stop()
+	if err != nil {
+		connection.Close()
+		return nil, contextError(ctx, err)
+	}
+	return tlsConnection, nil
+}
+
+func (graphite *graphite) connectUDP(ctx context.Context, dialer *net.Dialer) (net.Conn, error) {
 	address := graphite.config.getAddress()
 	log.Printf("Graphite: connecting to %s via UDP\n", address)
-	udpAddress, err := net.ResolveUDPAddr("udp", address)
-	if err == nil {
-		return net.DialUDP("udp", nil, udpAddress)
+	return dialer.DialContext(ctx, "udp", address)
+}
+
+func (graphite *graphite) connectUnix(ctx context.Context, dialer *net.Dialer, network string) (net.Conn, error) {
+	if graphite.config.Socket == "" {
+		return nil, fmt.Errorf("A socket path is required to connect via %s", network)
 	}
-	return nil, err
+	log.Printf("Graphite: connecting to %s via %s\n", graphite.config.Socket, network)
+	return dialer.DialContext(ctx, network, graphite.config.Socket)
 }
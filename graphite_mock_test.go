@@ -2,19 +2,30 @@ package graphite
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"strconv"
+	"time"
 )
 
 // MockGraphite implements the interface Graphite
 type MockGraphite struct {
-	Extra               map[string]interface{}
-	Data                map[string]string
-	MethodSend          func(*MockGraphite, string, string) (int, error)
-	MethodSendBuffer    func(*MockGraphite, *bytes.Buffer) (int, error)
-	MethodNewAggregator func(*MockGraphite) Aggregator
-	MethodConnect       func(*MockGraphite) error
-	MethodReconnect     func(*MockGraphite) error
-	MethodDisconnect    func(*MockGraphite) error
+	Extra                   map[string]interface{}
+	Data                    map[string]string
+	MethodSend              func(*MockGraphite, string, string) (int, error)
+	MethodSendContext       func(*MockGraphite, context.Context, string, string) (int, error)
+	MethodSendTagged        func(*MockGraphite, string, map[string]string, string) (int, error)
+	MethodSendAt            func(*MockGraphite, string, string, time.Time) (int, error)
+	MethodSendAtContext     func(*MockGraphite, context.Context, string, string, time.Time) (int, error)
+	MethodSendPoints        func(*MockGraphite, []Point) (int, error)
+	MethodSendPointsContext func(*MockGraphite, context.Context, []Point) (int, error)
+	MethodSendBuffer        func(*MockGraphite, *bytes.Buffer) (int, error)
+	MethodSendBufferContext func(*MockGraphite, context.Context, *bytes.Buffer) (int, error)
+	MethodNewAggregator     func(*MockGraphite) Aggregator
+	MethodConnect           func(*MockGraphite) error
+	MethodConnectContext    func(*MockGraphite, context.Context) error
+	MethodReconnect         func(*MockGraphite) error
+	MethodDisconnect        func(*MockGraphite) error
 }
 
 // Send is an implementation of Graphite interface to be used with the mocking object.
@@ -26,6 +37,58 @@ func (m *MockGraphite) Send(path string, value string) (int, error) {
 	return 0, nil
 }
 
+// SendContext is an implementation of Graphite interface to be used with the mocking object.
+func (m *MockGraphite) SendContext(ctx context.Context, path string, value string) (int, error) {
+	if m.MethodSendContext != nil {
+		return m.MethodSendContext(m, ctx, path, value)
+	}
+	return m.Send(path, value)
+}
+
+// SendTagged is an implementation of Graphite interface to be used with the mocking object.
+func (m *MockGraphite) SendTagged(path string, tags map[string]string, value string) (int, error) {
+	if m.MethodSendTagged != nil {
+		return m.MethodSendTagged(m, path, tags, value)
+	}
+	return m.Send(formatSeries(path, tags), value)
+}
+
+// SendAt is an implementation of Graphite interface to be used with the mocking object.
+func (m *MockGraphite) SendAt(path string, value string, timestamp time.Time) (int, error) {
+	if m.MethodSendAt != nil {
+		return m.MethodSendAt(m, path, value, timestamp)
+	}
+	m.Data[path] = fmt.Sprintf("%s:%s:%d", path, value, timestamp.Unix())
+	return 0, nil
+}
+
+// SendAtContext is an implementation of Graphite interface to be used with the mocking object.
+func (m *MockGraphite) SendAtContext(ctx context.Context, path string, value string, timestamp time.Time) (int, error) {
+	if m.MethodSendAtContext != nil {
+		return m.MethodSendAtContext(m, ctx, path, value, timestamp)
+	}
+	return m.SendAt(path, value, timestamp)
+}
+
+// SendPoints is an implementation of Graphite interface to be used with the mocking object.
+func (m *MockGraphite) SendPoints(points []Point) (int, error) {
+	if m.MethodSendPoints != nil {
+		return m.MethodSendPoints(m, points)
+	}
+	return m.SendPointsContext(context.Background(), points)
+}
+
+// SendPointsContext is an implementation of Graphite interface to be used with the mocking object.
+func (m *MockGraphite) SendPointsContext(ctx context.Context, points []Point) (int, error) {
+	if m.MethodSendPointsContext != nil {
+		return m.MethodSendPointsContext(m, ctx, points)
+	}
+	for _, point := range points {
+		m.SendAt(formatSeries(point.Path, point.Tags), strconv.FormatFloat(point.Value, 'f', -1, 64), point.Timestamp)
+	}
+	return 0, nil
+}
+
 // SendBuffer is an implementation of Graphite interface to be used with the mocking object.
 func (m *MockGraphite) SendBuffer(buffer *bytes.Buffer) (int, error) {
 	if m.MethodSendBuffer != nil {
@@ -35,12 +98,20 @@ func (m *MockGraphite) SendBuffer(buffer *bytes.Buffer) (int, error) {
 	return 0, nil
 }
 
+// SendBufferContext is an implementation of Graphite interface to be used with the mocking object.
+func (m *MockGraphite) SendBufferContext(ctx context.Context, buffer *bytes.Buffer) (int, error) {
+	if m.MethodSendBufferContext != nil {
+		return m.MethodSendBufferContext(m, ctx, buffer)
+	}
+	return m.SendBuffer(buffer)
+}
+
 // NewAggregator is an implementation of Graphite interface to be used with the mocking object.
 func (m *MockGraphite) NewAggregator() Aggregator {
 	if m.MethodNewAggregator != nil {
 		return m.MethodNewAggregator(m)
 	}
-	return &MockAggregator{}
+	return newAggregator(&Config{}, m)
 }
 
 // Connect is an implementation of Graphite interface to be used with the mocking object.
@@ -51,6 +122,14 @@ func (m *MockGraphite) Connect() error {
 	return nil
 }
 
+// ConnectContext is an implementation of Graphite interface to be used with the mocking object.
+func (m *MockGraphite) ConnectContext(ctx context.Context) error {
+	if m.MethodConnectContext != nil {
+		return m.MethodConnectContext(m, ctx)
+	}
+	return m.Connect()
+}
+
 // Reconnect is an implementation of Graphite interface to be used with the mocking object.
 func (m *MockGraphite) Reconnect() error {
 	if m.MethodReconnect != nil {
@@ -1,9 +1,20 @@
 package graphite_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"path/filepath"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -24,10 +35,10 @@ func tcpHandler(received chan string, listener net.Listener) {
 	fmt.Printf("Listening to connections to %s...\n", listener.Addr().String())
 	for {
 		connection, err := listener.Accept()
+		if err != nil {
+			return
+		}
 		go func(r chan string) {
-			if err != nil {
-				return
-			}
 			defer connection.Close()
 
 			buffer := make([]byte, MaxBuffer)
@@ -71,3 +82,102 @@ func createUDPServer(endpoint string) (net.PacketConn, chan string) {
 	go udpHandler(result, listener)
 	return listener, result
 }
+
+func createTLSServer(endpoint string, config *tls.Config) (net.Listener, chan string) {
+	result := make(chan string)
+	listener, err := tls.Listen("tcp", endpoint, config)
+	Expect(err).To(BeNil(), "Expected TLS server at %s", endpoint)
+	go tcpHandler(result, listener)
+	return listener, result
+}
+
+// Certificates stores the paths and the parsed certificates generated to test TLS connections.
+type Certificates struct {
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	CAPool     *x509.CertPool
+	ServerCert tls.Certificate
+}
+
+func writePEM(path string, kind string, data []byte) {
+	err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: data}), 0600)
+	Expect(err).To(BeNil(), "Expected to write %s", path)
+}
+
+func createCertificate(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	Expect(err).To(BeNil())
+	certificate, err := x509.ParseCertificate(der)
+	Expect(err).To(BeNil())
+	return certificate, key, der
+}
+
+// createCertificates generates a CA, a server certificate valid for serverName and a client
+// certificate, storing the CA and the client files in a temporary directory.
+func createCertificates(serverName string) *Certificates {
+	dir, err := ioutil.TempDir("", "graphite-tls")
+	Expect(err).To(BeNil())
+	validity := func(serial int64, name string) *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-1 * time.Hour),
+			NotAfter:     time.Now().Add(1 * time.Hour),
+		}
+	}
+
+	caTemplate := validity(1, "graphite-ca")
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign
+	ca, caKey, caDER := createCertificate(caTemplate, nil, nil)
+
+	serverTemplate := validity(2, serverName)
+	serverTemplate.DNSNames = []string{serverName}
+	serverTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	_, serverKey, serverDER := createCertificate(serverTemplate, ca, caKey)
+
+	clientTemplate := validity(3, "graphite-client")
+	clientTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	_, clientKey, clientDER := createCertificate(clientTemplate, ca, caKey)
+	clientKeyDER, err := x509.MarshalECPrivateKey(clientKey)
+	Expect(err).To(BeNil())
+
+	certificates := &Certificates{
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		CertFile: filepath.Join(dir, "client.pem"),
+		KeyFile:  filepath.Join(dir, "client.key"),
+		CAPool:   x509.NewCertPool(),
+		ServerCert: tls.Certificate{
+			Certificate: [][]byte{serverDER},
+			PrivateKey:  serverKey,
+		},
+	}
+	certificates.CAPool.AddCert(ca)
+	writePEM(certificates.CAFile, "CERTIFICATE", caDER)
+	writePEM(certificates.CertFile, "CERTIFICATE", clientDER)
+	writePEM(certificates.KeyFile, "EC PRIVATE KEY", clientKeyDER)
+	return certificates
+}
+
+func createUnixServer(path string) (net.Listener, chan string) {
+	result := make(chan string)
+	listener, err := net.Listen("unix", path)
+	Expect(err).To(BeNil(), "Expected unix server at %s", path)
+	go tcpHandler(result, listener)
+	return listener, result
+}
+
+func createUnixgramServer(path string) (net.PacketConn, chan string) {
+	result := make(chan string)
+	listener, err := net.ListenPacket("unixgram", path)
+	Expect(err).To(BeNil(), "Expected unixgram server at %s", path)
+	go udpHandler(result, listener)
+	return listener, result
+}
@@ -2,7 +2,14 @@ package graphite_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	. "github.com/gguridi/graphite-client"
 	. "github.com/onsi/ginkgo"
@@ -94,6 +101,70 @@ var _ = Describe("graphite client", func() {
 			Expect(n).To(Equal(21))
 		})
 
+		It("send a tagged metric to graphite with its tags in canonical order", func() {
+			client = NewGraphiteTCP(&Config{
+				Host: "localhost",
+				Port: 3000,
+				Tags: map[string]string{"dc": "eu"},
+			})
+			_, err := client.SendTagged("cpu.usage", map[string]string{"host": "web1"}, "10")
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(result).Should(Receive(&resultString))
+			Expect(resultString).To(MatchRegexp(`cpu.usage;dc=eu;host=web1 10 \d{10}\n`))
+		})
+
+		It("send a metric to graphite with the timestamp received", func() {
+			n, err := client.SendAt("metricA", "10", time.Unix(1554992147, 0))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(22))
+			Eventually(result).Should(Receive(&resultString))
+			Expect(resultString).To(MatchRegexp(`^metricA 10 1554992147\n`))
+		})
+
+		It("doesn't send a metric with the timestamp received if the context was cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			n, err := client.SendAtContext(ctx, "metricA", "10", time.Unix(1554992147, 0))
+			Expect(err).To(Equal(context.Canceled))
+			Expect(n).To(Equal(0))
+		})
+
+		It("send a batch of points to graphite with their own timestamps", func() {
+			n, err := client.SendPoints([]Point{
+				{Path: "metricA", Value: 10, Timestamp: time.Unix(1554992147, 0)},
+				{Path: "metricB", Value: 2.5, Timestamp: time.Unix(1554992148, 0), Tags: map[string]string{"dc": "eu"}},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(51))
+			Eventually(result).Should(Receive(&resultString))
+			Expect(resultString).To(MatchRegexp(`^metricA 10 1554992147\nmetricB;dc=eu 2.5 1554992148\n`))
+		})
+
+		It("send a metric to graphite with its path sanitized", func() {
+			client = NewGraphiteTCP(&Config{
+				Host:     "localhost",
+				Port:     3000,
+				Sanitize: SanitizeReplace,
+			})
+			_, err := client.Send("metric A\n..count", "10")
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(result).Should(Receive(&resultString))
+			Expect(resultString).To(MatchRegexp(`^metric_A_.count 10 \d{10}\n`))
+		})
+
+		It("returns an error without sending anything if the path is rejected", func() {
+			client = NewGraphiteTCP(&Config{
+				Host:         "localhost",
+				Port:         3000,
+				SanitizeTags: SanitizeReject,
+			})
+			n, err := client.SendTagged("cpu.usage", map[string]string{"host": "web 1"}, "10")
+			Expect(err).To(HaveOccurred())
+			Expect(n).To(Equal(0))
+			_, err = client.SendPoints([]Point{{Path: "cpu.usage;host", Value: 10, Timestamp: time.Now()}})
+			Expect(err).To(HaveOccurred())
+		})
+
 		It("send a whole buffer to graphite", func() {
 			client.Connect()
 			n, err := client.SendBuffer(bytes.NewBufferString("metric 10 1554992147\n"))
@@ -111,6 +182,136 @@ var _ = Describe("graphite client", func() {
 		})
 	})
 
+	Context("tls over tcp protocol", func() {
+
+		var (
+			listener     net.Listener
+			certificates *Certificates
+			serverConfig *tls.Config
+		)
+
+		BeforeEach(func() {
+			certificates = createCertificates("graphite.local")
+			serverConfig = &tls.Config{
+				Certificates: []tls.Certificate{certificates.ServerCert},
+				ClientCAs:    certificates.CAPool,
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+			}
+			client = NewGraphiteTCP(&Config{
+				Host: "localhost",
+				Port: 3003,
+				TLS: &TLSConfig{
+					CAFile:     certificates.CAFile,
+					CertFile:   certificates.CertFile,
+					KeyFile:    certificates.KeyFile,
+					ServerName: "graphite.local",
+				},
+			})
+		})
+
+		AfterEach(func() {
+			listener.Close()
+		})
+
+		It("send a message with metric and value to graphite through TLS", func() {
+			listener, result = createTLSServer(":3003", serverConfig)
+			n, err := client.Send("metricA", "10")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(22))
+			Eventually(result).Should(Receive(&resultString))
+			Expect(resultString).To(MatchRegexp(`metricA 10 \d{10}\n`))
+		})
+
+		It("returns an error if the server name doesn't match the certificate", func() {
+			listener, result = createTLSServer(":3003", serverConfig)
+			client = NewGraphiteTCP(&Config{
+				Host: "localhost",
+				Port: 3003,
+				TLS:  &TLSConfig{CAFile: certificates.CAFile},
+			})
+			err := client.Connect()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error if the server certificate is not signed by the root CAs", func() {
+			listener, result = createTLSServer(":3003", serverConfig)
+			client = NewGraphiteTCP(&Config{
+				Host: "localhost",
+				Port: 3003,
+				TLS:  &TLSConfig{ServerName: "graphite.local"},
+			})
+			err := client.Connect()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error if the server doesn't support the minimum version", func() {
+			serverConfig.MaxVersion = tls.VersionTLS11
+			listener, result = createTLSServer(":3003", serverConfig)
+			err := client.Connect()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error if the certificate files can't be loaded", func() {
+			listener, result = createTLSServer(":3003", serverConfig)
+			client = NewGraphiteTCP(&Config{
+				Host: "localhost",
+				Port: 3003,
+				TLS:  &TLSConfig{CAFile: certificates.CAFile, CertFile: "unknown.pem"},
+			})
+			err := client.Connect()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("pickle protocol", func() {
+
+		var (
+			listener net.Listener
+		)
+
+		BeforeEach(func() {
+			listener, result = createTCPServer(":3002")
+			client = NewGraphitePickle(&Config{
+				Host: "localhost",
+				Port: 3002,
+			})
+		})
+
+		AfterEach(func() {
+			listener.Close()
+		})
+
+		It("connects successfully if graphite is listening", func() {
+			err := client.Connect()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("send a message with metric and value to graphite as a pickle frame", func() {
+			n, err := client.Send("metricA", "10")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(38))
+			Eventually(result).Should(Receive(&resultString))
+			Expect(resultString).To(HavePrefix("\x00\x00\x00\x22\x80\x02]"))
+			Expect(resultString).To(ContainSubstring("X\x07\x00\x00\x00metricA"))
+		})
+
+		It("send a whole buffer to graphite in a single frame", func() {
+			client.Connect()
+			n, err := client.SendBuffer(bytes.NewBufferString("metricA 10 1554992147\nmetricB 20 1554992147\n"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(66))
+			Eventually(result).Should(Receive(&resultString))
+			Expect(resultString).To(ContainSubstring("metricA"))
+			Expect(resultString).To(ContainSubstring("metricB"))
+		})
+
+		It("returns an error if the buffer is not using the plaintext format", func() {
+			n, err := client.SendBuffer(bytes.NewBufferString("metricA 1554992147\n"))
+			Expect(err).To(HaveOccurred())
+			Expect(n).To(Equal(0))
+		})
+	})
+
 	Context("udp protocol", func() {
 
 		var (
@@ -198,6 +399,40 @@ var _ = Describe("graphite client", func() {
 			Expect(resultString).To(ContainSubstring("metric 10 1554992147\n"))
 		})
 
+		It("splits the buffer in several datagrams without splitting any metric", func() {
+			client = NewGraphiteUDP(&Config{
+				Host:          "localhost",
+				Port:          3001,
+				MaxPacketSize: 50,
+			})
+			buffer := bytes.NewBufferString("")
+			for i := 0; i < 5; i++ {
+				buffer.WriteString("metric 10 1554992147\n")
+			}
+			n, err := client.SendBuffer(buffer)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(105))
+			for _, expected := range []int{2, 2, 1} {
+				Eventually(result).Should(Receive(&resultString))
+				Expect(strings.Count(resultString, "metric 10 1554992147\n")).To(Equal(expected))
+			}
+		})
+
+		It("sends a metric bigger than the maximum size in its own datagram", func() {
+			client = NewGraphiteUDP(&Config{
+				Host:          "localhost",
+				Port:          3001,
+				MaxPacketSize: 10,
+			})
+			n, err := client.SendBuffer(bytes.NewBufferString("metric 10 1554992147\nmetric 20 1554992147"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(41))
+			Eventually(result).Should(Receive(&resultString))
+			Expect(resultString).To(HavePrefix("metric 10 1554992147\n\x00"))
+			Eventually(result).Should(Receive(&resultString))
+			Expect(resultString).To(HavePrefix("metric 20 1554992147\x00"))
+		})
+
 		It("doesn't return an error if can't deliver the metric to graphite because it's UDP", func() {
 			listener.Close()
 			n, err := client.Send("metricA", "10")
@@ -205,4 +440,304 @@ var _ = Describe("graphite client", func() {
 			Expect(n).To(Equal(22))
 		})
 	})
+
+	Context("unix socket protocols", func() {
+
+		var (
+			socket string
+		)
+
+		BeforeEach(func() {
+			dir, err := ioutil.TempDir("", "graphite-unix")
+			Expect(err).ToNot(HaveOccurred())
+			socket = filepath.Join(dir, "carbon.sock")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(filepath.Dir(socket))
+		})
+
+		It("returns an error if the socket path is not set", func() {
+			client = NewGraphiteUnix(&Config{})
+			err := client.Connect()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error if nothing is listening in the socket", func() {
+			client = NewGraphiteUnix(&Config{Socket: socket})
+			err := client.Connect()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("send a message with metric and value through a stream socket", func() {
+			listener, result := createUnixServer(socket)
+			defer listener.Close()
+			client = NewGraphiteUnix(&Config{Socket: socket})
+			n, err := client.Send("metricA", "10")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(22))
+			Eventually(result).Should(Receive(&resultString))
+			Expect(resultString).To(MatchRegexp(`metricA 10 \d{10}\n`))
+		})
+
+		It("send a whole buffer through a datagram socket", func() {
+			listener, result := createUnixgramServer(socket)
+			defer listener.Close()
+			client = NewGraphiteUnixgram(&Config{Socket: socket})
+			n, err := client.SendBuffer(bytes.NewBufferString("metric 10 1554992147\n"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(21))
+			Eventually(result).Should(Receive(&resultString))
+			Expect(resultString).To(ContainSubstring("metric 10 1554992147\n"))
+		})
+	})
+
+	Context("cluster of destinations", func() {
+
+		var (
+			listenerA net.Listener
+			listenerB net.Listener
+			resultA   chan string
+			resultB   chan string
+			config    *Config
+		)
+
+		BeforeEach(func() {
+			listenerA, resultA = createTCPServer(":3004")
+			listenerB, resultB = createTCPServer(":3005")
+			config = &Config{}
+		})
+
+		AfterEach(func() {
+			listenerA.Close()
+			listenerB.Close()
+		})
+
+		var newCluster = func() Graphite {
+			return NewGraphiteCluster(config, ProtocolTCP, []Destination{
+				{Host: "localhost", Port: 3004, Instance: "a"},
+				{Host: "localhost", Port: 3005, Instance: "b"},
+			})
+		}
+
+		It("connects successfully if all the destinations are listening", func() {
+			err := newCluster().Connect()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("routes each metric to the destination owning it in the ring", func() {
+			client = newCluster()
+			n, err := client.SendBuffer(bytes.NewBufferString("metric.a 1 1554992147\nmetric.c 2 1554992147\n"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(44))
+			Eventually(resultA).Should(Receive(&resultString))
+			Expect(resultString).To(HavePrefix("metric.c 2 1554992147\n\x00"))
+			Eventually(resultB).Should(Receive(&resultString))
+			Expect(resultString).To(HavePrefix("metric.a 1 1554992147\n\x00"))
+		})
+
+		It("sends each metric to several destinations with a replication factor", func() {
+			config.ReplicationFactor = 2
+			client = newCluster()
+			n, err := client.Send("metric.a", "1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(2 * 22))
+			Eventually(resultA).Should(Receive(&resultString))
+			Expect(resultString).To(MatchRegexp(`^metric.a 1 \d{10}\n`))
+			Eventually(resultB).Should(Receive(&resultString))
+			Expect(resultString).To(MatchRegexp(`^metric.a 1 \d{10}\n`))
+		})
+
+		It("keeps sending to the healthy destinations if one of them fails", func() {
+			listenerB.Close()
+			client = newCluster()
+			n, err := client.SendBuffer(bytes.NewBufferString("metric.a 1 1554992147\nmetric.c 2 1554992147\n"))
+			Expect(err).To(HaveOccurred())
+			Expect(n).To(Equal(22))
+			Eventually(resultA).Should(Receive(&resultString))
+			Expect(resultString).To(HavePrefix("metric.c 2 1554992147\n"))
+		})
+
+		It("fans out the metrics of its aggregators", func() {
+			aggregator := newCluster().NewAggregator()
+			aggregator.AddSum("metric.a", 1)
+			aggregator.AddSum("metric.c", 2)
+			_, err := aggregator.Flush()
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(resultA).Should(Receive(&resultString))
+			Expect(resultString).To(MatchRegexp(`^metric.c 2 \d{10}\n\x00`))
+			Eventually(resultB).Should(Receive(&resultString))
+			Expect(resultString).To(MatchRegexp(`^metric.a 1 \d{10}\n\x00`))
+		})
+	})
+
+	Context("failover between endpoints", func() {
+
+		var (
+			primary   net.Listener
+			secondary net.Listener
+			resultA   chan string
+			resultB   chan string
+		)
+
+		BeforeEach(func() {
+			primary, resultA = createTCPServer(":3006")
+			secondary, resultB = createTCPServer(":3007")
+			client = NewGraphiteFailover(ProtocolTCP,
+				&Config{Host: "localhost", Port: 3006, FailbackInterval: 500 * time.Millisecond, ForceReconnect: true},
+				&Config{Host: "localhost", Port: 3007, ForceReconnect: true},
+			)
+		})
+
+		AfterEach(func() {
+			primary.Close()
+			secondary.Close()
+		})
+
+		It("sends the metrics to the primary endpoint while it's available", func() {
+			_, err := client.Send("metricA", "10")
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(resultA).Should(Receive(&resultString))
+			Expect(resultString).To(MatchRegexp(`metricA 10 \d{10}\n`))
+		})
+
+		It("fails over to the next endpoint if the primary fails", func() {
+			primary.Close()
+			n, err := client.Send("metricA", "10")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(22))
+			Eventually(resultB).Should(Receive(&resultString))
+			Expect(resultString).To(MatchRegexp(`metricA 10 \d{10}\n`))
+		})
+
+		It("fails back to the primary endpoint once it recovers", func() {
+			primary.Close()
+			_, err := client.Send("metricA", "10")
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(resultB).Should(Receive())
+			primary, resultA = createTCPServer(":3006")
+			time.Sleep(600 * time.Millisecond)
+			_, err = client.Send("metricB", "20")
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(resultA).Should(Receive(&resultString))
+			Expect(resultString).To(MatchRegexp(`metricB 20 \d{10}\n`))
+		})
+
+		It("wraps around to the primary endpoint if the active one fails before probing", func() {
+			primary.Close()
+			_, err := client.Send("metricA", "10")
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(resultB).Should(Receive())
+			primary, resultA = createTCPServer(":3006")
+			secondary.Close()
+			_, err = client.Send("metricB", "20")
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(resultA).Should(Receive(&resultString))
+			Expect(resultString).To(MatchRegexp(`^metricB 20 \d{10}\n`))
+		})
+
+		It("returns an error if none of the endpoints is available", func() {
+			primary.Close()
+			secondary.Close()
+			n, err := client.Send("metricA", "10")
+			Expect(err).To(HaveOccurred())
+			Expect(n).To(Equal(0))
+		})
+
+		It("connects to the next endpoint if the primary is not listening", func() {
+			primary.Close()
+			err := client.Connect()
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Context("context aware operations", func() {
+
+		var (
+			listener    net.Listener
+			connections chan net.Conn
+			accepting   chan struct{}
+		)
+
+		BeforeEach(func() {
+			var err error
+			connections = make(chan net.Conn, 10)
+			accepting = make(chan struct{})
+			listener, err = net.Listen("tcp", ":3008")
+			Expect(err).ToNot(HaveOccurred())
+			go func(listener net.Listener, connections chan net.Conn, accepting chan struct{}) {
+				defer close(accepting)
+				for {
+					connection, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					connections <- connection
+				}
+			}(listener, connections, accepting)
+			client = NewGraphiteTCP(&Config{
+				Host: "localhost",
+				Port: 3008,
+			})
+		})
+
+		AfterEach(func() {
+			listener.Close()
+			<-accepting
+			close(connections)
+			for connection := range connections {
+				connection.Close()
+			}
+		})
+
+		It("connects successfully if the context is not cancelled", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+			defer cancel()
+			err := client.ConnectContext(ctx)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("doesn't connect if the context was cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := client.ConnectContext(ctx)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("doesn't send anything if the context was cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			n, err := client.SendContext(ctx, "metricA", "10")
+			Expect(err).To(Equal(context.Canceled))
+			Expect(n).To(Equal(0))
+		})
+
+		It("aborts a blocked write when the deadline of the context is exceeded", func() {
+			buffer := bytes.NewBufferString(strings.Repeat("metric 10 1554992147\n", 2000000))
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			n, err := client.SendBufferContext(ctx, buffer)
+			Expect(err).To(Equal(context.DeadlineExceeded))
+			Expect(n).To(BeNumerically("<", buffer.Len()))
+			Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+		})
+
+		It("aborts a blocked write when the context is cancelled", func() {
+			buffer := bytes.NewBufferString(strings.Repeat("metric 10 1554992147\n", 2000000))
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(200*time.Millisecond, cancel)
+			_, err := client.SendBufferContext(ctx, buffer)
+			Expect(err).To(Equal(context.Canceled))
+		})
+
+		It("keeps working after a write was aborted", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			client.SendContext(ctx, "metricA", "10")
+			n, err := client.SendContext(context.Background(), "metricA", "10")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(22))
+		})
+	})
 })
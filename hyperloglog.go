@@ -0,0 +1,150 @@
+package graphite
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"strconv"
+)
+
+const (
+	// DefaultUniqueBits specifies the default number of bits used to index the registers of the
+	// unique metrics, using 2^14 registers (16KB) with a standard error of 0.81%.
+	DefaultUniqueBits = 14
+)
+
+// MetricUnique creates a metric to count the number of distinct values received, like unique
+// users or unique IPs, using a HyperLogLog sketch. It doesn't store the values, so the memory
+// used is fixed regardless of their number, at the cost of sending an approximate count with
+// a standard error of 1.04/sqrt(2^Bits).
+type MetricUnique struct {
+	// Bits is the number of bits of the hash used to index the registers, between 4 and 16.
+	// Defaults to DefaultUniqueBits.
+	Bits uint8
+
+	registers []uint8
+}
+
+// Update adds a new value to the set of values counted. It receives strings, byte slices,
+// values implementing fmt.Stringer or numbers.
+func (metric *MetricUnique) Update(value interface{}) error {
+	var member []byte
+	switch value := value.(type) {
+	case string:
+		member = []byte(value)
+	case []byte:
+		member = value
+	case fmt.Stringer:
+		member = []byte(value.String())
+	default:
+		if _, err := toFloat64(value); err != nil {
+			return fmt.Errorf("Unsupported value of type %T, expected a string", value)
+		}
+		member = []byte(fmt.Sprint(value))
+	}
+	metric.add(hash64(member))
+	return nil
+}
+
+// Merge adds the values counted by other MetricUnique, which must use the same number of bits.
+func (metric *MetricUnique) Merge(value Metric) error {
+	other, ok := value.(*MetricUnique)
+	if !ok {
+		return mergeError(metric, value)
+	}
+	if other.registers == nil {
+		return nil
+	}
+	if metric.getBits() != other.getBits() {
+		return fmt.Errorf("Unable to merge unique metrics with %d and %d bits", other.getBits(), metric.getBits())
+	}
+	if metric.registers == nil {
+		metric.registers = make([]uint8, len(other.registers))
+	}
+	for index, register := range other.registers {
+		if register > metric.registers[index] {
+			metric.registers[index] = register
+		}
+	}
+	return nil
+}
+
+// Clear removes all the values counted.
+func (metric *MetricUnique) Clear() {
+	metric.registers = nil
+}
+
+// Calculate calculates the estimation of the number of distinct values to send.
+func (metric *MetricUnique) Calculate() string {
+	return strconv.FormatUint(metric.Count(), 10)
+}
+
+// Count returns the estimation of the number of distinct values received.
+func (metric *MetricUnique) Count() uint64 {
+	if metric.registers == nil {
+		return 0
+	}
+	m := float64(len(metric.registers))
+	sum := 0.0
+	zeros := 0
+	for _, register := range metric.registers {
+		sum += math.Pow(2, -float64(register))
+		if register == 0 {
+			zeros++
+		}
+	}
+	estimate := getAlpha(len(metric.registers)) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+func (metric *MetricUnique) getBits() uint8 {
+	if metric.Bits >= 4 && metric.Bits <= 16 {
+		return metric.Bits
+	}
+	return DefaultUniqueBits
+}
+
+// add updates the register indexed by the first bits of the hash with the position of the
+// first bit set in the rest of it, if it's higher than the current one.
+func (metric *MetricUnique) add(hash uint64) {
+	p := metric.getBits()
+	if metric.registers == nil {
+		metric.registers = make([]uint8, 1<<p)
+	}
+	index := hash >> (64 - p)
+	rank := uint8(bits.LeadingZeros64(hash<<p|1<<(p-1))) + 1
+	if rank > metric.registers[index] {
+		metric.registers[index] = rank
+	}
+}
+
+// getAlpha returns the constant correcting the bias of the estimation for m registers.
+func getAlpha(m int) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	}
+	return 0.7213 / (1 + 1.079/float64(m))
+}
+
+// hash64 hashes the value with FNV-1a, mixing the result with the finalizer of MurmurHash3 to
+// distribute the bits uniformly, as needed by the HyperLogLog registers.
+func hash64(value []byte) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write(value)
+	hash := hasher.Sum64()
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
@@ -0,0 +1,91 @@
+package graphite
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("unique metric", func() {
+
+	var (
+		metric *MetricUnique
+	)
+
+	BeforeEach(func() {
+		metric = &MetricUnique{}
+	})
+
+	It("should initialise with value zero", func() {
+		Expect(metric.Calculate()).To(Equal("0"))
+	})
+
+	It("should count the repeated values once", func() {
+		for i := 0; i < 100; i++ {
+			metric.Update("user-1")
+			metric.Update([]byte("user-2"))
+		}
+		Expect(metric.Calculate()).To(Equal("2"))
+	})
+
+	It("should estimate the number of distinct values within its standard error", func() {
+		for _, count := range []int{1000, 100000} {
+			metric.Clear()
+			for i := 0; i < count; i++ {
+				metric.Update(fmt.Sprintf("192.168.%d.%d", i/256, i%256))
+			}
+			errorRate := math.Abs(float64(metric.Count())-float64(count)) / float64(count)
+			Expect(errorRate).To(BeNumerically("<", 3*0.0081))
+		}
+	})
+
+	It("should use the number of registers configured", func() {
+		metric.Bits = 10
+		metric.Update("user-1")
+		Expect(metric.registers).To(HaveLen(1024))
+	})
+
+	It("should accept numbers and reject the rest of types", func() {
+		Expect(metric.Update(42)).To(Succeed())
+		Expect(metric.Update(true)).To(MatchError("Unsupported value of type bool, expected a string"))
+		Expect(metric.Calculate()).To(Equal("1"))
+	})
+
+	It("should merge the values counted by other unique metrics", func() {
+		other := &MetricUnique{}
+		metric.Update("user-1")
+		other.Update("user-1")
+		other.Update("user-2")
+		Expect(metric.Merge(other)).To(Succeed())
+		Expect(metric.Calculate()).To(Equal("2"))
+		Expect(metric.Merge(&MetricUnique{Bits: 10, registers: make([]uint8, 1024)})).To(HaveOccurred())
+	})
+
+	It("should clear the values counted", func() {
+		metric.Update("user-1")
+		metric.Clear()
+		Expect(metric.Calculate()).To(Equal("0"))
+	})
+
+	Context("used by the aggregator", func() {
+
+		It("counts the distinct values of each series between flushes", func() {
+			agg := newAggregator(&Config{UniqueBits: 12}, &MockGraphite{
+				MethodSendBuffer: func(m *MockGraphite, buffer *bytes.Buffer) (int, error) {
+					return buffer.Len(), nil
+				},
+			}).(*aggregator)
+			agg.AddUnique("users", "alice")
+			agg.AddUnique("users", "bob")
+			agg.AddUniqueTagged("users", map[string]string{"dc": "eu"}, "alice")
+			Expect(agg.GetMetrics()["users"].Calculate()).To(Equal("2"))
+			Expect(agg.GetMetrics()["users;dc=eu"].Calculate()).To(Equal("1"))
+			Expect(agg.GetMetrics()["users"].(*MetricUnique).registers).To(HaveLen(4096))
+			agg.Flush()
+			Expect(agg.GetMetrics()).To(BeEmpty())
+		})
+	})
+})
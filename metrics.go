@@ -2,15 +2,28 @@ package graphite
 
 import (
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
+	"time"
+)
+
+const (
+	// DefaultPrecision specifies the default number of decimals of the values sent by the metrics.
+	DefaultPrecision = 6
+	// PrecisionNone can be used as precision to send the values rounded, without decimals.
+	PrecisionNone = -1
+	// DefaultDurationUnit specifies the default unit the durations are converted to.
+	DefaultDurationUnit = time.Millisecond
 )
 
 // Metric is an interface to be able to create new metric types easily.
 // Each metric must have some methods to be able to be used by the Aggregator.
 type Metric interface {
 
-	// Update receives a generic value through interface{} to update its internal value.
-	Update(interface{})
+	// Update receives a generic value through interface{} to update its internal value. It
+	// returns an error, without updating the metric, if the type of the value is not supported.
+	Update(interface{}) error
 	// Clear is used to reset the metric to the initial value.
 	Clear()
 	// Calculate is used to perform the necessary operations to retrieve the final value
@@ -18,49 +31,148 @@ type Metric interface {
 	Calculate() string
 }
 
-// MetricSum creates a metric that contains a value that increases with time.
+// MultiMetric is an interface for the metrics that send several values to graphite on each flush.
+// Each value is sent with its suffix appended to the metric path, so a metric `request.time` with
+// the suffixes `count` and `max` will be sent as `request.time.count` and `request.time.max`.
+type MultiMetric interface {
+	Metric
+	// CalculateAll is used to retrieve all the values that will be sent to graphite, indexed
+	// by the suffix to append to the metric path.
+	CalculateAll() map[string]string
+}
+
+// RetainedMetric is an interface for the metrics that represent a current level, like a gauge, and
+// must be sent to graphite on every flush until they are removed, instead of being discarded once sent.
+type RetainedMetric interface {
+	Metric
+	// Retain returns whether the metric must be kept after being sent to graphite.
+	Retain() bool
+}
+
+// CommittedMetric is an interface for the metrics that calculate their values depending on the
+// previous ones sent, like the moving averages of a meter. The aggregator calls Commit once the
+// values calculated for a flush have been sent, so they are taken into account from then on.
+type CommittedMetric interface {
+	Metric
+	// Commit confirms the values calculated by the last call to Calculate or CalculateAll were sent.
+	Commit()
+}
+
+// MergeableMetric is an interface for the metrics that can combine the values of another metric
+// of the same type, so no values are lost when the metrics that couldn't be sent to graphite are
+// restored in the aggregator after being updated again.
+type MergeableMetric interface {
+	Metric
+	// Merge adds the values of the metric received, returning an error if it's not of the same type.
+	Merge(Metric) error
+}
+
+// MetricSum creates a metric that contains a value that increases with time. The integer values
+// are added apart from the float ones, so the integer sums don't lose precision.
 type MetricSum struct {
+	// Sum is the sum of the integer values received.
 	Sum int64
+	// FloatSum is the sum of the float values received.
+	FloatSum float64
+	// Precision is the number of decimals sent when the sum is not an integer. Defaults
+	// to DefaultPrecision.
+	Precision int
 }
 
-// Update increases the value of the metric with the amount received.
-func (metric *MetricSum) Update(value interface{}) {
-	metric.Sum += int64(value.(int))
+// Update increases the value of the metric with the amount received, of any numeric type.
+func (metric *MetricSum) Update(value interface{}) error {
+	if integer, ok := toInt64(value); ok {
+		metric.Sum += integer
+		return nil
+	}
+	number, err := toFloat64(value)
+	if err != nil {
+		return err
+	}
+	metric.FloatSum += number
+	return nil
+}
+
+// Merge adds the sum of other MetricSum.
+func (metric *MetricSum) Merge(other Metric) error {
+	sum, ok := other.(*MetricSum)
+	if !ok {
+		return mergeError(metric, other)
+	}
+	metric.Sum += sum.Sum
+	metric.FloatSum += sum.FloatSum
+	return nil
 }
 
 // Clear reinitiales the value to zero.
 func (metric *MetricSum) Clear() {
 	metric.Sum = 0
+	metric.FloatSum = 0
 }
 
-// Calculate calculates the value to send.
+// Calculate calculates the value to send. The integer sums are sent without decimals.
 func (metric *MetricSum) Calculate() string {
-	return strconv.FormatInt(metric.Sum, 10)
+	if metric.FloatSum == 0 {
+		return strconv.FormatInt(metric.Sum, 10)
+	}
+	return formatNumber(float64(metric.Sum)+metric.FloatSum, metric.Precision)
 }
 
-// MetricAverage creates a metric to store the average value between several values.
+// MetricAverage creates a metric to store the average value between several values. Like in
+// MetricSum, the integer values are added apart from the float ones.
 type MetricAverage struct {
-	Sum   int64
-	Count int64
+	// Sum is the sum of the integer values received.
+	Sum int64
+	// FloatSum is the sum of the float values received.
+	FloatSum float64
+	Count    int64
+	// Precision is the number of decimals sent. Defaults to DefaultPrecision.
+	Precision int
 }
 
 // Update increases the components necessary to calculate afterwards the average value.
 // Each time the metric is updated, the result of Calculate will change.
-func (metric *MetricAverage) Update(value interface{}) {
-	metric.Sum += int64(value.(int))
+func (metric *MetricAverage) Update(value interface{}) error {
+	if integer, ok := toInt64(value); ok {
+		metric.Sum += integer
+		metric.Count++
+		return nil
+	}
+	number, err := toFloat64(value)
+	if err != nil {
+		return err
+	}
+	metric.FloatSum += number
 	metric.Count++
+	return nil
+}
+
+// Merge adds the values of other MetricAverage.
+func (metric *MetricAverage) Merge(other Metric) error {
+	average, ok := other.(*MetricAverage)
+	if !ok {
+		return mergeError(metric, other)
+	}
+	metric.Sum += average.Sum
+	metric.FloatSum += average.FloatSum
+	metric.Count += average.Count
+	return nil
 }
 
 // Clear reinitiales the average value and counter.
 func (metric *MetricAverage) Clear() {
 	metric.Sum = 0
+	metric.FloatSum = 0
 	metric.Count = 0
 }
 
-// Calculate calculates the value to send.
+// Calculate calculates the value to send. The integer part of the integer sum is divided apart,
+// so it doesn't lose precision.
 func (metric *MetricAverage) Calculate() string {
-	if metric.Sum > 0 {
-		return fmt.Sprintf("%.6f", float64(metric.Sum)/float64(metric.Count))
+	if metric.Count > 0 {
+		quotient := float64(metric.Sum / metric.Count)
+		remainder := float64(metric.Sum%metric.Count) + metric.FloatSum
+		return formatFloat(quotient+remainder/float64(metric.Count), metric.Precision)
 	}
 	return "0"
 }
@@ -71,8 +183,18 @@ type MetricActive struct {
 }
 
 // Update sets the active/inactive status through a boolean.
-func (metric *MetricActive) Update(value interface{}) {
-	metric.State = value.(bool)
+func (metric *MetricActive) Update(value interface{}) error {
+	state, ok := value.(bool)
+	if !ok {
+		return fmt.Errorf("Unsupported value of type %T, expected a boolean", value)
+	}
+	metric.State = state
+	return nil
+}
+
+// Retain keeps the status after flushing, so it's sent until it's removed.
+func (metric *MetricActive) Retain() bool {
+	return true
 }
 
 // Clear reinitiales the value to inactive.
@@ -85,3 +207,459 @@ func (metric *MetricActive) Calculate() string {
 	bool2integer := map[bool]int{false: 0, true: 1}
 	return strconv.Itoa(bool2integer[metric.State])
 }
+
+// MetricGauge creates a metric to store the current level of something, like the size of a queue.
+// Its value is sent to graphite on every flush until it's removed.
+type MetricGauge struct {
+	Value float64
+	// Precision is the number of decimals sent when the value is not an integer. Defaults
+	// to DefaultPrecision.
+	Precision int
+}
+
+// gaugeDelta is the amount to increase or decrease a gauge, instead of setting its value.
+type gaugeDelta float64
+
+// Update sets the value of the gauge, of any numeric type.
+func (metric *MetricGauge) Update(value interface{}) error {
+	if delta, ok := value.(gaugeDelta); ok {
+		metric.Value += float64(delta)
+		return nil
+	}
+	number, err := toFloat64(value)
+	if err != nil {
+		return err
+	}
+	metric.Value = number
+	return nil
+}
+
+// Retain keeps the value after flushing, so it's sent until it's removed.
+func (metric *MetricGauge) Retain() bool {
+	return true
+}
+
+// Clear reinitiales the value to zero.
+func (metric *MetricGauge) Clear() {
+	metric.Value = 0
+}
+
+// Calculate calculates the value to send. The integer values are sent without decimals.
+func (metric *MetricGauge) Calculate() string {
+	return formatNumber(metric.Value, metric.Precision)
+}
+
+// MetricMin creates a metric to store the minimum value received between flushes.
+type MetricMin struct {
+	Min   float64
+	Count int64
+	// Precision is the number of decimals sent when the value is not an integer. Defaults
+	// to DefaultPrecision.
+	Precision int
+}
+
+// Update keeps the value received, of any numeric type, if it's lower than the current one.
+func (metric *MetricMin) Update(value interface{}) error {
+	number, err := toFloat64(value)
+	if err != nil {
+		return err
+	}
+	if metric.Count == 0 || number < metric.Min {
+		metric.Min = number
+	}
+	metric.Count++
+	return nil
+}
+
+// Merge keeps the minimum of other MetricMin if it's lower than the current one.
+func (metric *MetricMin) Merge(other Metric) error {
+	min, ok := other.(*MetricMin)
+	if !ok {
+		return mergeError(metric, other)
+	}
+	if min.Count > 0 && (metric.Count == 0 || min.Min < metric.Min) {
+		metric.Min = min.Min
+	}
+	metric.Count += min.Count
+	return nil
+}
+
+// Clear reinitiales the value.
+func (metric *MetricMin) Clear() {
+	metric.Min = 0
+	metric.Count = 0
+}
+
+// Calculate calculates the value to send. The integer values are sent without decimals.
+func (metric *MetricMin) Calculate() string {
+	return formatNumber(metric.Min, metric.Precision)
+}
+
+// MetricMax creates a metric to store the maximum value received between flushes.
+type MetricMax struct {
+	Max   float64
+	Count int64
+	// Precision is the number of decimals sent when the value is not an integer. Defaults
+	// to DefaultPrecision.
+	Precision int
+}
+
+// Update keeps the value received, of any numeric type, if it's higher than the current one.
+func (metric *MetricMax) Update(value interface{}) error {
+	number, err := toFloat64(value)
+	if err != nil {
+		return err
+	}
+	if metric.Count == 0 || number > metric.Max {
+		metric.Max = number
+	}
+	metric.Count++
+	return nil
+}
+
+// Merge keeps the maximum of other MetricMax if it's higher than the current one.
+func (metric *MetricMax) Merge(other Metric) error {
+	max, ok := other.(*MetricMax)
+	if !ok {
+		return mergeError(metric, other)
+	}
+	if max.Count > 0 && (metric.Count == 0 || max.Max > metric.Max) {
+		metric.Max = max.Max
+	}
+	metric.Count += max.Count
+	return nil
+}
+
+// Clear reinitiales the value.
+func (metric *MetricMax) Clear() {
+	metric.Max = 0
+	metric.Count = 0
+}
+
+// Calculate calculates the value to send. The integer values are sent without decimals.
+func (metric *MetricMax) Calculate() string {
+	return formatNumber(metric.Max, metric.Precision)
+}
+
+// MetricLast creates a metric to store the latest value received between flushes. Unlike the
+// gauges, it's not sent again once flushed until a new value is received.
+type MetricLast struct {
+	Last float64
+	// Precision is the number of decimals sent when the value is not an integer. Defaults
+	// to DefaultPrecision.
+	Precision int
+}
+
+// Update replaces the value with the one received, of any numeric type.
+func (metric *MetricLast) Update(value interface{}) error {
+	number, err := toFloat64(value)
+	if err != nil {
+		return err
+	}
+	metric.Last = number
+	return nil
+}
+
+// Clear reinitiales the value to zero.
+func (metric *MetricLast) Clear() {
+	metric.Last = 0
+}
+
+// Calculate calculates the value to send. The integer values are sent without decimals.
+func (metric *MetricLast) Calculate() string {
+	return formatNumber(metric.Last, metric.Precision)
+}
+
+// MetricMeter creates a metric to measure the rate of events per second, like the requests
+// received, sending to graphite on each flush the total count, the rate since the previous flush
+// and the 1, 5 and 15 minutes exponentially weighted moving averages, like Dropwizard meters. The
+// meter is sent on every flush until it's removed, so the moving averages decay when idle. The
+// meters created by the aggregator start their first interval at its previous flush; otherwise it
+// starts with the first event, and as it's partial it doesn't initialise the moving averages.
+type MetricMeter struct {
+	Count  float64
+	Total  float64
+	Rate1  float64
+	Rate5  float64
+	Rate15 float64
+	// Precision is the number of decimals sent. Defaults to DefaultPrecision.
+	Precision int
+
+	start   time.Time
+	partial bool
+	ticked  bool
+	pending *MetricMeter
+	now     func() time.Time
+}
+
+// Update marks the number of events received, of any numeric type.
+func (metric *MetricMeter) Update(value interface{}) error {
+	number, err := toFloat64(value)
+	if err != nil {
+		return err
+	}
+	if metric.start.IsZero() {
+		metric.start = metric.getNow()
+		metric.partial = true
+	}
+	metric.Count += number
+	metric.Total += number
+	return nil
+}
+
+// Retain keeps the meter after flushing.
+func (metric *MetricMeter) Retain() bool {
+	return true
+}
+
+// Commit confirms the rates calculated by the last call to CalculateAll were sent, starting
+// a new interval. If they weren't calculated, it does nothing.
+func (metric *MetricMeter) Commit() {
+	if pending := metric.pending; pending != nil {
+		metric.Count -= pending.Count
+		metric.Rate1, metric.Rate5, metric.Rate15 = pending.Rate1, pending.Rate5, pending.Rate15
+		metric.start = pending.start
+		metric.partial = false
+		metric.ticked = true
+		metric.pending = nil
+	}
+}
+
+// Clear reinitiales the counters and the rates.
+func (metric *MetricMeter) Clear() {
+	metric.Count = 0
+	metric.Total = 0
+	metric.Rate1, metric.Rate5, metric.Rate15 = 0, 0, 0
+	metric.start = time.Time{}
+	metric.partial = false
+	metric.ticked = false
+	metric.pending = nil
+}
+
+// Calculate calculates the rate per second since the previous flush.
+func (metric *MetricMeter) Calculate() string {
+	return formatFloat(metric.getRate(metric.getNow()), metric.Precision)
+}
+
+// CalculateAll calculates the count, the rate per second since the previous flush and the moving
+// averages to send, indexed by their suffix.
+func (metric *MetricMeter) CalculateAll() map[string]string {
+	now := metric.getNow()
+	rate := metric.getRate(now)
+	elapsed := now.Sub(metric.start)
+	first := !metric.ticked && !metric.partial
+	metric.pending = &MetricMeter{
+		Count:  metric.Count,
+		Rate1:  ewma(metric.Rate1, rate, elapsed, time.Minute, first),
+		Rate5:  ewma(metric.Rate5, rate, elapsed, 5*time.Minute, first),
+		Rate15: ewma(metric.Rate15, rate, elapsed, 15*time.Minute, first),
+		start:  now,
+	}
+	return map[string]string{
+		"count":    strconv.FormatFloat(metric.Total, 'f', -1, 64),
+		"rate":     formatFloat(rate, metric.Precision),
+		"m1_rate":  formatFloat(metric.pending.Rate1, metric.Precision),
+		"m5_rate":  formatFloat(metric.pending.Rate5, metric.Precision),
+		"m15_rate": formatFloat(metric.pending.Rate15, metric.Precision),
+	}
+}
+
+func (metric *MetricMeter) getRate(now time.Time) float64 {
+	elapsed := now.Sub(metric.start).Seconds()
+	if metric.start.IsZero() || elapsed <= 0 {
+		return 0
+	}
+	return metric.Count / elapsed
+}
+
+func (metric *MetricMeter) getNow() time.Time {
+	if metric.now != nil {
+		return metric.now()
+	}
+	return time.Now()
+}
+
+// ewma calculates the exponentially weighted moving average of the rates over the window,
+// weighting the new rate according to the time elapsed since the previous one. The rate of the
+// first complete interval initialises the average.
+func ewma(average float64, rate float64, elapsed time.Duration, window time.Duration, first bool) float64 {
+	if first {
+		return rate
+	}
+	alpha := 1 - math.Exp(-elapsed.Seconds()/window.Seconds())
+	return average + alpha*(rate-average)
+}
+
+// MetricHistogram creates a metric to store the distribution of several values, like timings,
+// and send its statistics to graphite: count, min, max, mean, median, p90, p99 and stddev.
+// All the values received between flushes are kept in memory to calculate the percentiles.
+type MetricHistogram struct {
+	Values []float64
+	// Precision is the number of decimals sent. Defaults to DefaultPrecision.
+	Precision int
+}
+
+// Update adds a new value, of any numeric type, to the distribution.
+func (metric *MetricHistogram) Update(value interface{}) error {
+	number, err := toFloat64(value)
+	if err != nil {
+		return err
+	}
+	metric.Values = append(metric.Values, number)
+	return nil
+}
+
+// Merge adds the values of other MetricHistogram to the distribution.
+func (metric *MetricHistogram) Merge(other Metric) error {
+	histogram, ok := other.(*MetricHistogram)
+	if !ok {
+		return mergeError(metric, other)
+	}
+	metric.Values = append(metric.Values, histogram.Values...)
+	return nil
+}
+
+// Clear removes all the values of the distribution.
+func (metric *MetricHistogram) Clear() {
+	metric.Values = nil
+}
+
+// Calculate calculates the mean of the distribution, used when a single value is needed.
+func (metric *MetricHistogram) Calculate() string {
+	if len(metric.Values) == 0 {
+		return "0"
+	}
+	return formatFloat(metric.mean(), metric.Precision)
+}
+
+// CalculateAll calculates the statistics of the distribution to send, indexed by their suffix.
+// If there are no values only the count is sent.
+func (metric *MetricHistogram) CalculateAll() map[string]string {
+	count := len(metric.Values)
+	values := map[string]string{"count": strconv.Itoa(count)}
+	if count == 0 {
+		return values
+	}
+	sorted := append([]float64{}, metric.Values...)
+	sort.Float64s(sorted)
+	mean := metric.mean()
+	variance := 0.0
+	for _, value := range sorted {
+		variance += (value - mean) * (value - mean)
+	}
+	values["min"] = formatFloat(sorted[0], metric.Precision)
+	values["max"] = formatFloat(sorted[count-1], metric.Precision)
+	values["mean"] = formatFloat(mean, metric.Precision)
+	values["median"] = formatFloat(percentile(sorted, 50), metric.Precision)
+	values["p90"] = formatFloat(percentile(sorted, 90), metric.Precision)
+	values["p99"] = formatFloat(percentile(sorted, 99), metric.Precision)
+	values["stddev"] = formatFloat(math.Sqrt(variance/float64(count)), metric.Precision)
+	return values
+}
+
+func (metric *MetricHistogram) mean() float64 {
+	sum := 0.0
+	for _, value := range metric.Values {
+		sum += value
+	}
+	return sum / float64(len(metric.Values))
+}
+
+// percentile calculates the percentile of the sorted values, interpolating linearly between
+// the closest ranks.
+func percentile(sorted []float64, p float64) float64 {
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+func mergeError(metric Metric, other Metric) error {
+	return fmt.Errorf("Unable to merge a metric of type %T into %T", other, metric)
+}
+
+// toFloat64 converts any numeric value to float64. The durations are converted to
+// DefaultDurationUnit.
+func toFloat64(value interface{}) (float64, error) {
+	switch value := value.(type) {
+	case int:
+		return float64(value), nil
+	case int8:
+		return float64(value), nil
+	case int16:
+		return float64(value), nil
+	case int32:
+		return float64(value), nil
+	case int64:
+		return float64(value), nil
+	case uint:
+		return float64(value), nil
+	case uint8:
+		return float64(value), nil
+	case uint16:
+		return float64(value), nil
+	case uint32:
+		return float64(value), nil
+	case uint64:
+		return float64(value), nil
+	case float32:
+		return float64(value), nil
+	case float64:
+		return value, nil
+	case time.Duration:
+		return toUnit(value, DefaultDurationUnit), nil
+	}
+	return 0, fmt.Errorf("Unsupported value of type %T, expected a number", value)
+}
+
+// toInt64 converts the integer types to int64, returning false for the rest of types and for
+// the unsigned values that don't fit in an int64.
+func toInt64(value interface{}) (int64, bool) {
+	switch value := value.(type) {
+	case int:
+		return int64(value), true
+	case int8:
+		return int64(value), true
+	case int16:
+		return int64(value), true
+	case int32:
+		return int64(value), true
+	case int64:
+		return value, true
+	case uint:
+		return int64(value), uint64(value) <= math.MaxInt64
+	case uint8:
+		return int64(value), true
+	case uint16:
+		return int64(value), true
+	case uint32:
+		return int64(value), true
+	case uint64:
+		return int64(value), value <= math.MaxInt64
+	}
+	return 0, false
+}
+
+// toUnit converts a duration to the unit received, keeping the fractions.
+func toUnit(duration time.Duration, unit time.Duration) float64 {
+	return float64(duration) / float64(unit)
+}
+
+// formatNumber formats the value like formatFloat, but without decimals if it's an integer.
+func formatNumber(value float64, precision int) string {
+	if value == math.Trunc(value) {
+		return strconv.FormatFloat(value, 'f', 0, 64)
+	}
+	return formatFloat(value, precision)
+}
+
+// formatFloat formats the value with the number of decimals received, using DefaultPrecision if
+// it's zero or no decimals at all if it's negative.
+func formatFloat(value float64, precision int) string {
+	if precision == 0 {
+		precision = DefaultPrecision
+	} else if precision < 0 {
+		precision = 0
+	}
+	return strconv.FormatFloat(value, 'f', precision, 64)
+}
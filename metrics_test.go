@@ -1,6 +1,8 @@
 package graphite
 
 import (
+	"time"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -33,6 +35,37 @@ var _ = Describe("graphite metrics", func() {
 			metric.Clear()
 			Expect(metric.Calculate()).To(Equal("0"))
 		})
+
+		It("should accept any numeric type", func() {
+			for _, value := range []interface{}{int8(1), int16(1), int32(1), int64(1), uint(1), uint8(1), uint16(1), uint32(1), uint64(1), float32(1)} {
+				Expect(metric.Update(value)).To(Succeed())
+			}
+			Expect(metric.Calculate()).To(Equal("10"))
+		})
+
+		It("should sum decimal values without truncating them", func() {
+			metric.Update(1.25)
+			metric.Update(2)
+			Expect(metric.Calculate()).To(Equal("3.250000"))
+		})
+
+		It("should sum the integer values above 2^53 without losing precision", func() {
+			metric.Update(int64(1) << 62)
+			metric.Update(1)
+			metric.Update(uint64(1))
+			Expect(metric.Calculate()).To(Equal("4611686018427387906"))
+		})
+
+		It("should convert the durations to milliseconds", func() {
+			metric.Update(1500 * time.Microsecond)
+			Expect(metric.Calculate()).To(Equal("1.500000"))
+		})
+
+		It("should return an error for unsupported types without updating the value", func() {
+			metric.Update(5)
+			Expect(metric.Update("5")).To(MatchError("Unsupported value of type string, expected a number"))
+			Expect(metric.Calculate()).To(Equal("5"))
+		})
 	})
 
 	Context("metric average", func() {
@@ -63,6 +96,28 @@ var _ = Describe("graphite metrics", func() {
 			Expect(metric.Calculate()).To(Equal("3.333333"))
 		})
 
+		It("should use the precision configured", func() {
+			metric.Precision = 2
+			metric.Update(1)
+			metric.Update(3)
+			metric.Update(6)
+			Expect(metric.Calculate()).To(Equal("3.33"))
+			metric.Precision = PrecisionNone
+			Expect(metric.Calculate()).To(Equal("3"))
+		})
+
+		It("should average the integer values above 2^53 without losing precision", func() {
+			metric.Update(int64(1) << 62)
+			metric.Update(-(int64(1) << 62) + 4)
+			Expect(metric.Calculate()).To(Equal("2.000000"))
+		})
+
+		It("should calculate the average of negative values", func() {
+			metric.Update(-2)
+			metric.Update(-4.5)
+			Expect(metric.Calculate()).To(Equal("-3.250000"))
+		})
+
 		It("should clear the internal value", func() {
 			metric.Update(5)
 			metric.Clear()
@@ -84,6 +139,10 @@ var _ = Describe("graphite metrics", func() {
 			Expect(metric.Calculate()).To(Equal("0"))
 		})
 
+		It("should return an error if the value is not a boolean", func() {
+			Expect(metric.Update(1)).To(MatchError("Unsupported value of type int, expected a boolean"))
+		})
+
 		It("should update the internal value with the status received", func() {
 			metric.Update(true)
 			Expect(metric.Calculate()).To(Equal("1"))
@@ -97,4 +156,248 @@ var _ = Describe("graphite metrics", func() {
 			Expect(metric.Calculate()).To(Equal("0"))
 		})
 	})
+
+	Context("metric min/max/last", func() {
+
+		It("should keep the minimum value received", func() {
+			metric := MetricMin{}
+			Expect(metric.Calculate()).To(Equal("0"))
+			metric.Update(5)
+			metric.Update(-2.5)
+			metric.Update(10)
+			Expect(metric.Calculate()).To(Equal("-2.500000"))
+			metric.Clear()
+			metric.Update(7)
+			Expect(metric.Calculate()).To(Equal("7"))
+		})
+
+		It("should keep the maximum value received", func() {
+			metric := MetricMax{}
+			Expect(metric.Calculate()).To(Equal("0"))
+			metric.Update(-5)
+			metric.Update(-8)
+			Expect(metric.Calculate()).To(Equal("-5"))
+			metric.Update(int64(10))
+			Expect(metric.Calculate()).To(Equal("10"))
+		})
+
+		It("should keep the latest value received", func() {
+			metric := MetricLast{}
+			metric.Update(5)
+			metric.Update(2)
+			Expect(metric.Calculate()).To(Equal("2"))
+			metric.Clear()
+			Expect(metric.Calculate()).To(Equal("0"))
+		})
+
+		It("should return an error for unsupported types", func() {
+			Expect((&MetricMin{}).Update("1")).To(HaveOccurred())
+			Expect((&MetricMax{}).Update("1")).To(HaveOccurred())
+			Expect((&MetricLast{}).Update("1")).To(HaveOccurred())
+		})
+	})
+
+	Context("metric gauge", func() {
+
+		var (
+			metric MetricGauge
+		)
+
+		BeforeEach(func() {
+			metric = MetricGauge{}
+		})
+
+		It("should implement RetainedMetric interface", func() {
+			var _ RetainedMetric = (*MetricGauge)(nil)
+			Expect(metric.Retain()).To(BeTrue())
+		})
+
+		It("should keep the latest value received", func() {
+			metric.Update(5)
+			metric.Update(2.5)
+			Expect(metric.Calculate()).To(Equal("2.500000"))
+		})
+
+		It("should increase and decrease the value with the deltas received", func() {
+			metric.Update(5)
+			metric.Update(gaugeDelta(3))
+			metric.Update(gaugeDelta(-10))
+			Expect(metric.Calculate()).To(Equal("-2"))
+		})
+
+		It("should clear the internal value", func() {
+			metric.Update(5)
+			metric.Clear()
+			Expect(metric.Calculate()).To(Equal("0"))
+		})
+	})
+
+	Context("metric meter", func() {
+
+		var (
+			metric MetricMeter
+			now    time.Time
+		)
+
+		BeforeEach(func() {
+			now = time.Unix(1554992147, 0)
+			metric = MetricMeter{start: now, now: func() time.Time { return now }}
+		})
+
+		It("should implement MultiMetric, RetainedMetric and CommittedMetric interfaces", func() {
+			var _ MultiMetric = (*MetricMeter)(nil)
+			var _ RetainedMetric = (*MetricMeter)(nil)
+			var _ CommittedMetric = (*MetricMeter)(nil)
+		})
+
+		It("should calculate the rate per second since the start of the interval", func() {
+			now = now.Add(8 * time.Second)
+			metric.Update(30)
+			now = now.Add(2 * time.Second)
+			metric.Update(20)
+			Expect(metric.Calculate()).To(Equal("5.000000"))
+		})
+
+		It("should start the interval with the first event if it's unknown", func() {
+			metric = MetricMeter{now: func() time.Time { return now }}
+			metric.Update(30)
+			now = now.Add(10 * time.Second)
+			metric.Update(20)
+			Expect(metric.Calculate()).To(Equal("5.000000"))
+		})
+
+		It("should initialise the moving averages with the rate of the first interval", func() {
+			metric.Update(60)
+			now = now.Add(time.Minute)
+			Expect(metric.CalculateAll()).To(Equal(map[string]string{
+				"count":    "60",
+				"rate":     "1.000000",
+				"m1_rate":  "1.000000",
+				"m5_rate":  "1.000000",
+				"m15_rate": "1.000000",
+			}))
+		})
+
+		It("should not initialise the moving averages with a partial first interval", func() {
+			metric = MetricMeter{now: func() time.Time { return now }}
+			metric.Update(60)
+			now = now.Add(time.Minute)
+			Expect(metric.CalculateAll()).To(Equal(map[string]string{
+				"count":    "60",
+				"rate":     "1.000000",
+				"m1_rate":  "0.632121",
+				"m5_rate":  "0.181269",
+				"m15_rate": "0.064493",
+			}))
+		})
+
+		It("should start a new interval once committed, decaying the moving averages", func() {
+			metric.Update(60)
+			now = now.Add(time.Minute)
+			metric.CalculateAll()
+			metric.Commit()
+			now = now.Add(time.Minute)
+			values := metric.CalculateAll()
+			Expect(values["count"]).To(Equal("60"))
+			Expect(values["rate"]).To(Equal("0.000000"))
+			Expect(values["m1_rate"]).To(Equal("0.367879"))
+			Expect(values["m5_rate"]).To(Equal("0.818731"))
+			Expect(values["m15_rate"]).To(Equal("0.935507"))
+		})
+
+		It("should not start a new interval if the rates weren't sent", func() {
+			metric.Update(60)
+			now = now.Add(time.Minute)
+			metric.CalculateAll()
+			Expect(metric.Retain()).To(BeTrue())
+			Expect(metric.Retain()).To(BeTrue())
+			now = now.Add(time.Minute)
+			Expect(metric.CalculateAll()["rate"]).To(Equal("0.500000"))
+		})
+
+		It("should clear the internal values", func() {
+			metric.Update(5)
+			metric.Clear()
+			Expect(metric.Calculate()).To(Equal("0.000000"))
+			Expect(metric.CalculateAll()["count"]).To(Equal("0"))
+		})
+	})
+
+	Context("metric histogram", func() {
+
+		var (
+			metric MetricHistogram
+		)
+
+		BeforeEach(func() {
+			metric = MetricHistogram{}
+		})
+
+		It("should implement MultiMetric interface", func() {
+			var _ MultiMetric = (*MetricHistogram)(nil)
+		})
+
+		It("should initialise with count zero", func() {
+			Expect(metric.Calculate()).To(Equal("0"))
+			Expect(metric.CalculateAll()).To(Equal(map[string]string{"count": "0"}))
+		})
+
+		It("should calculate the statistics of the values received", func() {
+			for _, value := range []int{7, 3, 10, 1, 5, 9, 2, 8, 4, 6} {
+				metric.Update(value)
+			}
+			Expect(metric.CalculateAll()).To(Equal(map[string]string{
+				"count":  "10",
+				"min":    "1.000000",
+				"max":    "10.000000",
+				"mean":   "5.500000",
+				"median": "5.500000",
+				"p90":    "9.100000",
+				"p99":    "9.910000",
+				"stddev": "2.872281",
+			}))
+			Expect(metric.Calculate()).To(Equal("5.500000"))
+		})
+
+		It("should accept decimal values", func() {
+			metric.Update(1.5)
+			metric.Update(2)
+			Expect(metric.CalculateAll()["mean"]).To(Equal("1.750000"))
+		})
+
+		It("should clear the internal values", func() {
+			metric.Update(5)
+			metric.Clear()
+			Expect(metric.CalculateAll()).To(Equal(map[string]string{"count": "0"}))
+		})
+	})
+
+	Context("mergeable metrics", func() {
+
+		It("should merge the values of other metrics of the same type", func() {
+			sum, average := &MetricSum{Sum: 5}, &MetricAverage{Sum: 4, Count: 2}
+			Expect(sum.Merge(&MetricSum{Sum: 3})).To(Succeed())
+			Expect(average.Merge(&MetricAverage{Sum: 8, Count: 2})).To(Succeed())
+			Expect(sum.Calculate()).To(Equal("8"))
+			Expect(average.Calculate()).To(Equal("3.000000"))
+		})
+
+		It("should keep the extremes when merging", func() {
+			min, max := &MetricMin{}, &MetricMax{Max: 5, Count: 1}
+			Expect(min.Merge(&MetricMin{Min: 3, Count: 1})).To(Succeed())
+			Expect(max.Merge(&MetricMax{})).To(Succeed())
+			Expect(min.Calculate()).To(Equal("3"))
+			Expect(max.Calculate()).To(Equal("5"))
+		})
+
+		It("should merge the distributions", func() {
+			histogram := &MetricHistogram{Values: []float64{1}}
+			Expect(histogram.Merge(&MetricHistogram{Values: []float64{3}})).To(Succeed())
+			Expect(histogram.Calculate()).To(Equal("2.000000"))
+		})
+
+		It("should return an error when merging metrics of different types", func() {
+			Expect((&MetricSum{}).Merge(&MetricAverage{})).To(MatchError("Unable to merge a metric of type *graphite.MetricAverage into *graphite.MetricSum"))
+		})
+	})
 })
@@ -0,0 +1,129 @@
+package graphite
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	// PickleMaxMetrics specifies the maximum amount of metrics that will be sent in a single
+	// pickle frame. It matches the default MAX_DATAPOINTS_PER_MESSAGE used by carbon itself.
+	PickleMaxMetrics = 500
+)
+
+// Opcodes of the pickle protocol 2 used to serialise the metrics.
+const (
+	pickleProto      = 0x80
+	pickleEmptyList  = ']'
+	pickleMark       = '('
+	pickleAppends    = 'e'
+	pickleBinUnicode = 'X'
+	pickleBinInt     = 'J'
+	pickleBinFloat   = 'G'
+	pickleTuple2     = 0x86
+	pickleStop       = '.'
+)
+
+// pickleMetric stores the information of a single metric line to be serialised.
+type pickleMetric struct {
+	path      string
+	value     float64
+	timestamp int64
+}
+
+// parsePlaintext converts a buffer using the plaintext protocol into a list of metrics
+// that can be serialised with the pickle protocol.
+func parsePlaintext(buffer *bytes.Buffer) ([]pickleMetric, error) {
+	metrics := []pickleMetric{}
+	scanner := bufio.NewScanner(bytes.NewReader(buffer.Bytes()))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Invalid metric line %q", scanner.Text())
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid metric value %q: %s", fields[1], err.Error())
+		}
+		timestamp, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid metric timestamp %q: %s", fields[2], err.Error())
+		}
+		metrics = append(metrics, pickleMetric{path: fields[0], value: value, timestamp: timestamp})
+	}
+	return metrics, scanner.Err()
+}
+
+// encodePickle serialises the buffer received in plaintext format into one or more
+// length-prefixed pickle frames, as expected by the carbon pickle receiver.
+func encodePickle(buffer *bytes.Buffer) ([]byte, error) {
+	metrics, err := parsePlaintext(buffer)
+	if err != nil {
+		return nil, err
+	}
+	frames := bytes.NewBuffer(nil)
+	for start := 0; start < len(metrics); start += PickleMaxMetrics {
+		end := start + PickleMaxMetrics
+		if end > len(metrics) {
+			end = len(metrics)
+		}
+		payload := picklePayload(metrics[start:end])
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, uint32(len(payload)))
+		frames.Write(header)
+		frames.Write(payload)
+	}
+	return frames.Bytes(), nil
+}
+
+// picklePayload serialises a list of metrics as [(path, (timestamp, value)), ...].
+func picklePayload(metrics []pickleMetric) []byte {
+	payload := bytes.NewBuffer(nil)
+	payload.Write([]byte{pickleProto, 2, pickleEmptyList})
+	if len(metrics) > 0 {
+		payload.WriteByte(pickleMark)
+		for _, metric := range metrics {
+			pickleString(payload, metric.path)
+			pickleTimestamp(payload, metric.timestamp)
+			pickleFloat(payload, metric.value)
+			payload.Write([]byte{pickleTuple2, pickleTuple2})
+		}
+		payload.WriteByte(pickleAppends)
+	}
+	payload.WriteByte(pickleStop)
+	return payload.Bytes()
+}
+
+func pickleString(payload *bytes.Buffer, value string) {
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(len(value)))
+	payload.WriteByte(pickleBinUnicode)
+	payload.Write(size)
+	payload.WriteString(value)
+}
+
+func pickleTimestamp(payload *bytes.Buffer, timestamp int64) {
+	if timestamp < math.MinInt32 || timestamp > math.MaxInt32 {
+		pickleFloat(payload, float64(timestamp))
+		return
+	}
+	value := make([]byte, 4)
+	binary.LittleEndian.PutUint32(value, uint32(int32(timestamp)))
+	payload.WriteByte(pickleBinInt)
+	payload.Write(value)
+}
+
+func pickleFloat(payload *bytes.Buffer, number float64) {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, math.Float64bits(number))
+	payload.WriteByte(pickleBinFloat)
+	payload.Write(value)
+}
@@ -0,0 +1,59 @@
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("pickle protocol", func() {
+
+	var getFrames = func(data []byte) [][]byte {
+		frames := [][]byte{}
+		for len(data) >= 4 {
+			size := binary.BigEndian.Uint32(data[:4])
+			frames = append(frames, data[4:4+size])
+			data = data[4+size:]
+		}
+		return frames
+	}
+
+	It("serialises a metric as a list of (path, (timestamp, value)) tuples", func() {
+		data, err := encodePickle(bytes.NewBufferString("a.b 1.5 1554992147\n"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data[:4]).To(Equal([]byte{0, 0, 0, 30}))
+		Expect(data[4:]).To(Equal([]byte{
+			0x80, 2, ']', '(',
+			'X', 3, 0, 0, 0, 'a', '.', 'b',
+			'J', 0x13, 0x4c, 0xaf, 0x5c,
+			'G', 0x3f, 0xf8, 0, 0, 0, 0, 0, 0,
+			0x86, 0x86, 'e', '.',
+		}))
+	})
+
+	It("ignores empty lines in the buffer", func() {
+		data, err := encodePickle(bytes.NewBufferString("\na 1 1554992147\n\nb 2 1554992147\n"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(getFrames(data)).To(HaveLen(1))
+	})
+
+	It("returns an error if a line can't be parsed", func() {
+		_, err := encodePickle(bytes.NewBufferString("metric 1554992147\n"))
+		Expect(err).To(HaveOccurred())
+		_, err = encodePickle(bytes.NewBufferString("metric ten 1554992147\n"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("splits the metrics in several frames if there are too many", func() {
+		buffer := bytes.NewBufferString("")
+		for i := 0; i < PickleMaxMetrics*2+1; i++ {
+			buffer.WriteString(fmt.Sprintf("metric.%d %d 1554992147\n", i, i))
+		}
+		data, err := encodePickle(buffer)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(getFrames(data)).To(HaveLen(3))
+	})
+})
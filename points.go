@@ -0,0 +1,84 @@
+package graphite
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultBackfillChunkSize specifies the default maximum number of points sent in each write
+	// by SendPoints.
+	DefaultBackfillChunkSize = 1000
+)
+
+// Point is a metric with its own timestamp, used to send historical data to graphite.
+type Point struct {
+	Path      string
+	Value     float64
+	Timestamp time.Time
+	// Tags are the tags of the series, merged with the default ones of the configuration.
+	Tags map[string]string
+}
+
+// line returns the line representing the point in the plaintext protocol.
+func (point Point) line(config *Config) (string, error) {
+	path, err := config.getTaggedPath(point.Path, point.Tags)
+	if err != nil {
+		return "", err
+	}
+	value := strconv.FormatFloat(point.Value, 'f', -1, 64)
+	return format(path, value, point.Timestamp.Unix()), nil
+}
+
+// sendPoints sends the points through the client in chunks of the BackfillChunkSize of the
+// configuration, waiting between them to not exceed its BackfillRate if it's set.
+func sendPoints(ctx context.Context, client Graphite, config *Config, points []Point) (int, error) {
+	chunkSize := config.getBackfillChunkSize()
+	start := time.Now()
+	total := 0
+	for sent := 0; sent < len(points); sent += chunkSize {
+		if err := waitRate(ctx, start, sent, config.BackfillRate); err != nil {
+			return total, err
+		}
+		end := sent + chunkSize
+		if end > len(points) {
+			end = len(points)
+		}
+		buffer := bytes.NewBufferString("")
+		for _, point := range points[sent:end] {
+			line, err := point.line(config)
+			if err != nil {
+				return total, err
+			}
+			buffer.WriteString(line)
+		}
+		n, err := client.SendBufferContext(ctx, buffer)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// waitRate waits until the points already sent since the start don't exceed the rate
+// of points per second, or until the context is done.
+func waitRate(ctx context.Context, start time.Time, sent int, rate int) error {
+	if rate <= 0 || sent == 0 {
+		return ctx.Err()
+	}
+	wait := time.Until(start.Add(time.Duration(sent) * time.Second / time.Duration(rate)))
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
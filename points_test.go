@@ -0,0 +1,77 @@
+package graphite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("points backfill", func() {
+
+	var (
+		client *MockGraphite
+		writes []string
+		points []Point
+	)
+
+	BeforeEach(func() {
+		writes = []string{}
+		client = &MockGraphite{
+			MethodSendBufferContext: func(m *MockGraphite, ctx context.Context, buffer *bytes.Buffer) (int, error) {
+				writes = append(writes, buffer.String())
+				return buffer.Len(), nil
+			},
+		}
+		points = []Point{}
+		for i := 0; i < 5; i++ {
+			points = append(points, Point{Path: "jobs", Value: float64(i) + 0.5, Timestamp: time.Unix(1554992147+int64(i), 0)})
+		}
+	})
+
+	It("formats the points with their own timestamp and tags", func() {
+		config := &Config{Tags: map[string]string{"dc": "eu"}}
+		point := Point{Path: "jobs", Value: 15, Timestamp: time.Unix(1554992147, 0), Tags: map[string]string{"queue": "high"}}
+		Expect(point.line(config)).To(Equal("jobs;dc=eu;queue=high 15 1554992147\n"))
+	})
+
+	It("sends the points in chunks", func() {
+		n, err := sendPoints(context.Background(), client, &Config{BackfillChunkSize: 2}, points)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(writes).To(Equal([]string{
+			"jobs 0.5 1554992147\njobs 1.5 1554992148\n",
+			"jobs 2.5 1554992149\njobs 3.5 1554992150\n",
+			"jobs 4.5 1554992151\n",
+		}))
+		Expect(n).To(Equal(100))
+	})
+
+	It("limits the rate of points sent per second", func() {
+		start := time.Now()
+		_, err := sendPoints(context.Background(), client, &Config{BackfillChunkSize: 1, BackfillRate: 20}, points)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically(">=", 200*time.Millisecond))
+		Expect(writes).To(HaveLen(5))
+	})
+
+	It("stops waiting if the context is cancelled", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := sendPoints(ctx, client, &Config{BackfillChunkSize: 1, BackfillRate: 1}, points)
+		Expect(err).To(Equal(context.DeadlineExceeded))
+		Expect(writes).To(HaveLen(1))
+	})
+
+	It("stops with the first chunk that can't be sent", func() {
+		client.MethodSendBufferContext = func(m *MockGraphite, ctx context.Context, buffer *bytes.Buffer) (int, error) {
+			writes = append(writes, buffer.String())
+			return 0, errors.New("Unable to send metrics to graphite")
+		}
+		_, err := sendPoints(context.Background(), client, &Config{BackfillChunkSize: 2}, points)
+		Expect(err).To(HaveOccurred())
+		Expect(writes).To(HaveLen(1))
+	})
+})
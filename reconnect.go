@@ -0,0 +1,181 @@
+package graphite
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultReconnectInitialInterval specifies the default time to wait after the first failed connection.
+	DefaultReconnectInitialInterval = 100 * time.Millisecond
+	// DefaultReconnectMaxInterval specifies the default maximum time to wait between connection attempts.
+	DefaultReconnectMaxInterval = 30 * time.Second
+	// DefaultReconnectMultiplier specifies the default factor applied to the interval after each failure.
+	DefaultReconnectMultiplier = 2.0
+)
+
+// ReconnectPolicy specifies how the client behaves when it can't connect with graphite, so that during
+// an outage the callers don't pay a full dial timeout on every send.
+type ReconnectPolicy struct {
+	// InitialInterval is the time to wait after the first failed connection. Defaults to 100 milliseconds.
+	InitialInterval time.Duration
+	// MaxInterval is the maximum time to wait between connection attempts. Defaults to 30 seconds.
+	MaxInterval time.Duration
+	// Multiplier is the factor applied to the interval after each consecutive failure. Defaults to 2.
+	Multiplier float64
+	// Jitter is the fraction (between 0 and 1) of the interval that is randomly subtracted from it, so
+	// several clients don't reconnect at the same time. Defaults to 0, without jitter.
+	Jitter float64
+	// FailureThreshold is the amount of consecutive failures that open the circuit breaker. While
+	// open, any attempt fails immediately with a CircuitOpenError. Defaults to 0, disabled.
+	FailureThreshold int
+	// OpenTimeout is the time the circuit breaker stays open before allowing a new attempt.
+	// Defaults to MaxInterval.
+	OpenTimeout time.Duration
+}
+
+func (policy *ReconnectPolicy) getInitialInterval() time.Duration {
+	if policy.InitialInterval > 0 {
+		return policy.InitialInterval
+	}
+	return DefaultReconnectInitialInterval
+}
+
+func (policy *ReconnectPolicy) getMaxInterval() time.Duration {
+	if policy.MaxInterval > 0 {
+		return policy.MaxInterval
+	}
+	return DefaultReconnectMaxInterval
+}
+
+func (policy *ReconnectPolicy) getMultiplier() float64 {
+	if policy.Multiplier > 0 {
+		return policy.Multiplier
+	}
+	return DefaultReconnectMultiplier
+}
+
+func (policy *ReconnectPolicy) getOpenTimeout() time.Duration {
+	if policy.OpenTimeout > 0 {
+		return policy.OpenTimeout
+	}
+	return policy.getMaxInterval()
+}
+
+// getInterval returns the time to wait after the specified amount of consecutive failures.
+func (policy *ReconnectPolicy) getInterval(failures int) time.Duration {
+	interval := float64(policy.getInitialInterval()) * math.Pow(policy.getMultiplier(), float64(failures-1))
+	if max := float64(policy.getMaxInterval()); interval > max {
+		interval = max
+	}
+	if policy.Jitter > 0 {
+		interval -= interval * math.Min(policy.Jitter, 1) * rand.Float64()
+	}
+	return time.Duration(interval)
+}
+
+// BackoffError is returned when trying to connect before the backoff interval after a failed
+// connection has passed.
+type BackoffError struct {
+	Address  string
+	Failures int
+	RetryAt  time.Time
+}
+
+func (err *BackoffError) Error() string {
+	return fmt.Sprintf("Backing off the connection to %s after %d failures until %s",
+		err.Address, err.Failures, err.RetryAt.Format(time.RFC3339Nano))
+}
+
+// CircuitOpenError is returned when trying to connect while the circuit breaker is open.
+type CircuitOpenError struct {
+	Address  string
+	Failures int
+	RetryAt  time.Time
+}
+
+func (err *CircuitOpenError) Error() string {
+	return fmt.Sprintf("Circuit breaker to %s is open after %d failures until %s",
+		err.Address, err.Failures, err.RetryAt.Format(time.RFC3339Nano))
+}
+
+// isReconnectPolicyError returns if the error was caused by the reconnect policy, without trying to connect.
+func isReconnectPolicyError(err error) bool {
+	switch err.(type) {
+	case *BackoffError, *CircuitOpenError:
+		return true
+	}
+	return false
+}
+
+// reconnector keeps the state of the connection attempts to apply the reconnect policy.
+type reconnector struct {
+	policy   *ReconnectPolicy
+	address  string
+	failures int
+	open     bool
+	retryAt  time.Time
+	now      func() time.Time
+	mutex    sync.Mutex
+}
+
+func newReconnector(policy *ReconnectPolicy, address string) *reconnector {
+	return &reconnector{
+		policy:  policy,
+		address: address,
+		now:     time.Now,
+	}
+}
+
+// allow returns a typed error if a connection can't be attempted yet.
+func (reconnector *reconnector) allow() error {
+	if reconnector.policy == nil {
+		return nil
+	}
+	reconnector.mutex.Lock()
+	defer reconnector.mutex.Unlock()
+	if reconnector.now().Before(reconnector.retryAt) {
+		if reconnector.open {
+			return &CircuitOpenError{Address: reconnector.address, Failures: reconnector.failures, RetryAt: reconnector.retryAt}
+		}
+		return &BackoffError{Address: reconnector.address, Failures: reconnector.failures, RetryAt: reconnector.retryAt}
+	}
+	return nil
+}
+
+func (reconnector *reconnector) success() {
+	if reconnector.policy == nil {
+		return
+	}
+	reconnector.mutex.Lock()
+	defer reconnector.mutex.Unlock()
+	if reconnector.open {
+		log.Printf("Graphite: circuit breaker to %s closed\n", reconnector.address)
+	}
+	reconnector.failures = 0
+	reconnector.open = false
+	reconnector.retryAt = time.Time{}
+}
+
+func (reconnector *reconnector) failure() {
+	if reconnector.policy == nil {
+		return
+	}
+	reconnector.mutex.Lock()
+	defer reconnector.mutex.Unlock()
+	reconnector.failures++
+	threshold := reconnector.policy.FailureThreshold
+	if threshold > 0 && reconnector.failures >= threshold {
+		if !reconnector.open {
+			log.Printf("Graphite: circuit breaker to %s opened after %d failures\n", reconnector.address, reconnector.failures)
+		}
+		reconnector.open = true
+		reconnector.retryAt = reconnector.now().Add(reconnector.policy.getOpenTimeout())
+		return
+	}
+	reconnector.retryAt = reconnector.now().Add(reconnector.policy.getInterval(reconnector.failures))
+}
@@ -0,0 +1,166 @@
+package graphite
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("reconnect policy", func() {
+
+	Context("backoff intervals", func() {
+
+		It("uses the default values if none are provided", func() {
+			policy := &ReconnectPolicy{}
+			Expect(policy.getInterval(1)).To(Equal(100 * time.Millisecond))
+			Expect(policy.getInterval(2)).To(Equal(200 * time.Millisecond))
+			Expect(policy.getInterval(20)).To(Equal(30 * time.Second))
+			Expect(policy.getOpenTimeout()).To(Equal(30 * time.Second))
+		})
+
+		It("grows exponentially up to the maximum interval", func() {
+			policy := &ReconnectPolicy{
+				InitialInterval: 1 * time.Second,
+				MaxInterval:     10 * time.Second,
+				Multiplier:      3,
+			}
+			Expect(policy.getInterval(1)).To(Equal(1 * time.Second))
+			Expect(policy.getInterval(2)).To(Equal(3 * time.Second))
+			Expect(policy.getInterval(3)).To(Equal(9 * time.Second))
+			Expect(policy.getInterval(4)).To(Equal(10 * time.Second))
+		})
+
+		It("subtracts a random jitter from the interval", func() {
+			policy := &ReconnectPolicy{InitialInterval: 1 * time.Second, Jitter: 0.5}
+			for i := 0; i < 100; i++ {
+				Expect(policy.getInterval(1)).To(BeNumerically(">=", 500*time.Millisecond))
+				Expect(policy.getInterval(1)).To(BeNumerically("<=", 1*time.Second))
+			}
+		})
+	})
+
+	Context("reconnector", func() {
+
+		var (
+			current     time.Time
+			reconnector *reconnector
+		)
+
+		BeforeEach(func() {
+			current = time.Now()
+			reconnector = newReconnector(&ReconnectPolicy{
+				InitialInterval:  1 * time.Second,
+				FailureThreshold: 3,
+				OpenTimeout:      1 * time.Minute,
+			}, "example.com:2003")
+			reconnector.now = func() time.Time { return current }
+		})
+
+		It("always allows to connect if there is no policy", func() {
+			reconnector = newReconnector(nil, "example.com:2003")
+			reconnector.failure()
+			Expect(reconnector.allow()).To(Succeed())
+		})
+
+		It("allows to connect if there were no failures", func() {
+			Expect(reconnector.allow()).To(Succeed())
+		})
+
+		It("returns a backoff error until the interval has passed", func() {
+			reconnector.failure()
+			err := reconnector.allow()
+			Expect(err).To(BeAssignableToTypeOf(&BackoffError{}))
+			Expect(err.(*BackoffError).RetryAt).To(Equal(current.Add(1 * time.Second)))
+			current = current.Add(1 * time.Second)
+			Expect(reconnector.allow()).To(Succeed())
+		})
+
+		It("opens the circuit breaker after the failure threshold", func() {
+			for i := 0; i < 3; i++ {
+				reconnector.failure()
+			}
+			err := reconnector.allow()
+			Expect(err).To(BeAssignableToTypeOf(&CircuitOpenError{}))
+			Expect(err.(*CircuitOpenError).Failures).To(Equal(3))
+			current = current.Add(30 * time.Second)
+			Expect(reconnector.allow()).To(BeAssignableToTypeOf(&CircuitOpenError{}))
+			current = current.Add(30 * time.Second)
+			Expect(reconnector.allow()).To(Succeed())
+		})
+
+		It("opens the circuit breaker again if the trial attempt fails", func() {
+			for i := 0; i < 3; i++ {
+				reconnector.failure()
+			}
+			current = current.Add(1 * time.Minute)
+			reconnector.failure()
+			Expect(reconnector.allow()).To(BeAssignableToTypeOf(&CircuitOpenError{}))
+		})
+
+		It("resets the state after a successful connection", func() {
+			for i := 0; i < 3; i++ {
+				reconnector.failure()
+			}
+			reconnector.success()
+			Expect(reconnector.allow()).To(Succeed())
+			reconnector.failure()
+			Expect(reconnector.allow()).To(BeAssignableToTypeOf(&BackoffError{}))
+		})
+	})
+
+	Context("used by the client and the aggregator", func() {
+
+		var (
+			client Graphite
+		)
+
+		BeforeEach(func() {
+			client = NewGraphiteTCP(&Config{
+				Host: "localhost",
+				Port: 3010,
+				Reconnect: &ReconnectPolicy{
+					InitialInterval:  1 * time.Minute,
+					FailureThreshold: 2,
+				},
+			})
+		})
+
+		It("fails fast while backing off instead of dialing again", func() {
+			_, err := client.Send("metric", "1")
+			Expect(err).To(HaveOccurred())
+			Expect(isReconnectPolicyError(err)).To(BeFalse())
+			_, err = client.Send("metric", "1")
+			Expect(err).To(BeAssignableToTypeOf(&BackoffError{}))
+		})
+
+		It("fails fast when retrying from the aggregator", func() {
+			aggregator := client.NewAggregator()
+			aggregator.AddSum("metric", 1)
+			_, err := aggregator.Flush()
+			Expect(err).To(HaveOccurred())
+			_, err = aggregator.Retry()
+			Expect(err).To(BeAssignableToTypeOf(&BackoffError{}))
+		})
+
+		It("doesn't flush if the reconnection was not allowed", func() {
+			flushed := false
+			mock := &MockGraphite{
+				MethodReconnect: func(m *MockGraphite) error {
+					return &CircuitOpenError{}
+				},
+				MethodSendBuffer: func(m *MockGraphite, buffer *bytes.Buffer) (int, error) {
+					flushed = true
+					return 0, errors.New("Unable to send metrics to graphite")
+				},
+			}
+			aggregator := newAggregator(&Config{}, mock)
+			aggregator.AddSum("metric", 1)
+			_, err := aggregator.Retry()
+			Expect(err).To(BeAssignableToTypeOf(&CircuitOpenError{}))
+			Expect(flushed).To(BeFalse())
+		})
+	})
+})
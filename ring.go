@@ -0,0 +1,83 @@
+package graphite
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+const (
+	// RingReplicas specifies the amount of points each node has in the consistent hashing ring,
+	// matching the replica count used by carbon-relay.
+	RingReplicas = 100
+)
+
+type ringEntry struct {
+	position int
+	node     string
+}
+
+// hashRing is a port of the carbon-relay ConsistentHashRing (carbon_ch hash type), so
+// the metrics are routed to the same destinations as carbon-relay would do.
+type hashRing struct {
+	entries []ringEntry
+	nodes   []string
+}
+
+func newHashRing(nodes []string) *hashRing {
+	ring := &hashRing{}
+	for _, node := range nodes {
+		ring.addNode(node)
+	}
+	return ring
+}
+
+func (ring *hashRing) getPosition(key string) int {
+	hash := md5.Sum([]byte(key))
+	return int(binary.BigEndian.Uint16(hash[:2]))
+}
+
+func (ring *hashRing) addNode(node string) {
+	ring.nodes = append(ring.nodes, node)
+	used := map[int]bool{}
+	for _, entry := range ring.entries {
+		used[entry.position] = true
+	}
+	for i := 0; i < RingReplicas; i++ {
+		position := ring.getPosition(fmt.Sprintf("%s:%d", node, i))
+		for used[position] {
+			position++
+		}
+		used[position] = true
+		ring.entries = append(ring.entries, ringEntry{position: position, node: node})
+	}
+	sort.Slice(ring.entries, func(i, j int) bool {
+		return ring.entries[i].position < ring.entries[j].position
+	})
+}
+
+// getNodes returns up to count different nodes where the key must be sent, starting
+// by the one owning the position of the key in the ring.
+func (ring *hashRing) getNodes(key string, count int) []string {
+	if len(ring.entries) == 0 {
+		return nil
+	}
+	if count > len(ring.nodes) {
+		count = len(ring.nodes)
+	}
+	position := ring.getPosition(key)
+	index := sort.Search(len(ring.entries), func(i int) bool {
+		return ring.entries[i].position >= position
+	}) % len(ring.entries)
+	nodes := []string{}
+	seen := map[string]bool{}
+	for i := 0; i < len(ring.entries) && len(nodes) < count; i++ {
+		entry := ring.entries[(index+i)%len(ring.entries)]
+		if !seen[entry.node] {
+			seen[entry.node] = true
+			nodes = append(nodes, entry.node)
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,65 @@
+package graphite
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("consistent hashing ring", func() {
+
+	var (
+		nodeA = Destination{Host: "127.0.0.1"}.key()
+		nodeB = Destination{Host: "127.0.0.2"}.key()
+		nodeC = Destination{Host: "127.0.0.3"}.key()
+		ring  *hashRing
+	)
+
+	BeforeEach(func() {
+		ring = newHashRing([]string{nodeA, nodeB, nodeC})
+	})
+
+	It("represents the destinations as the carbon-relay (server, instance) tuples", func() {
+		Expect(Destination{Host: "127.0.0.1", Port: 2004}.key()).To(Equal("('127.0.0.1', None)"))
+		Expect(Destination{Host: "127.0.0.1", Port: 2004, Instance: "a"}.key()).To(Equal("('127.0.0.1', 'a')"))
+	})
+
+	It("identifies by their port the destinations that would collide", func() {
+		keys, destinations := destinationKeys([]Destination{
+			{Host: "127.0.0.1", Port: 2004},
+			{Host: "127.0.0.1", Port: 2104},
+			{Host: "127.0.0.2", Port: 2004},
+			{Host: "127.0.0.2", Port: 2004},
+		})
+		Expect(keys).To(Equal([]string{"('127.0.0.1:2004', None)", "('127.0.0.1:2104', None)", "('127.0.0.2', None)"}))
+		Expect(destinations).To(HaveLen(3))
+	})
+
+	It("places the replicas of the nodes in the same positions as carbon-relay", func() {
+		Expect(ring.entries).To(HaveLen(3 * RingReplicas))
+		Expect(ring.entries[:3]).To(Equal([]ringEntry{
+			{position: 724, node: nodeA},
+			{position: 872, node: nodeB},
+			{position: 1004, node: nodeC},
+		}))
+	})
+
+	It("routes the metrics to the same nodes as carbon-relay", func() {
+		Expect(ring.getNodes("metric.a", 1)).To(Equal([]string{nodeA}))
+		Expect(ring.getNodes("metric.b", 1)).To(Equal([]string{nodeC}))
+		Expect(ring.getNodes("servers.web1.cpu", 1)).To(Equal([]string{nodeC}))
+		Expect(ring.getNodes("b", 1)).To(Equal([]string{nodeB}))
+	})
+
+	It("returns different nodes in ring order for the replicas", func() {
+		Expect(ring.getNodes("metric.b", 2)).To(Equal([]string{nodeC, nodeB}))
+		Expect(ring.getNodes("c", 3)).To(Equal([]string{nodeB, nodeC, nodeA}))
+	})
+
+	It("doesn't return more nodes than the available ones", func() {
+		Expect(ring.getNodes("metric.a", 5)).To(HaveLen(3))
+	})
+
+	It("doesn't return any node if the ring is empty", func() {
+		Expect(newHashRing(nil).getNodes("metric.a", 1)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,184 @@
+package graphite
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// SanitizePolicy specifies what to do with the paths and tags containing characters that would
+// corrupt the plaintext protocol, like whitespaces, newlines, empty nodes or non-ASCII characters.
+type SanitizePolicy string
+
+const (
+	// SanitizeNone sends the paths as they are received. For the tags, it works like SanitizeReplace.
+	SanitizeNone SanitizePolicy = ""
+	// SanitizeReplace replaces the characters not allowed by an underscore, and removes the empty
+	// nodes of the paths.
+	SanitizeReplace SanitizePolicy = "replace"
+	// SanitizeStrip removes the characters not allowed, and the empty nodes of the paths.
+	SanitizeStrip SanitizePolicy = "strip"
+	// SanitizeReject discards the metric, returning an error describing the invalid path or tag.
+	SanitizeReject SanitizePolicy = "reject"
+)
+
+const (
+	// pathSeparator separates the nodes of a path.
+	pathSeparator = "."
+	// replacement replaces the characters not allowed in the paths and the tags.
+	replacement = '_'
+)
+
+// ValidatePath returns an error if the path, in the format name;tag1=value1;tag2=value2, contains
+// characters not allowed by the plaintext protocol: whitespaces, control or non-ASCII characters and
+// empty nodes in the name, and the characters described in ValidateTag in the tags.
+//
+//         if err := graphite.ValidatePath(userPath); err != nil {
+//             return err
+//         }
+func ValidatePath(path string) error {
+	if err := validateName(strings.Split(path, tagSeparator)[0]); err != nil {
+		return err
+	}
+	return validateSeriesTags(path)
+}
+
+// ValidateTag returns an error if the key or the value of the tag are empty or contain characters
+// not allowed by graphite: ;!^= in the key, ; in the value or ~ as its first character, plus
+// whitespaces and control characters in both.
+func ValidateTag(key, value string) error {
+	if key == "" || value == "" {
+		return fmt.Errorf("Invalid tag %q=%q, the key and the value can't be empty", key, value)
+	}
+	if r, found := findInvalid(key, isValidTagKeyRune); found {
+		return fmt.Errorf("Invalid character %q in the tag key %q", r, key)
+	}
+	if r, found := findInvalid(value, isValidTagValueRune); found {
+		return fmt.Errorf("Invalid character %q in the tag value %q", r, value)
+	}
+	if strings.HasPrefix(value, "~") {
+		return fmt.Errorf("Invalid tag value %q, it can't start with ~", value)
+	}
+	return nil
+}
+
+// validateSeriesTags returns an error if any of the tags of the series is not valid.
+func validateSeriesTags(series string) error {
+	for _, part := range strings.Split(series, tagSeparator)[1:] {
+		pair := strings.SplitN(part, "=", 2)
+		if len(pair) != 2 {
+			return fmt.Errorf("Invalid tag %q in %q, expected the format key=value", part, series)
+		}
+		if err := ValidateTag(pair[0], pair[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateName returns an error if the name of a series is empty, contains empty nodes or
+// characters not allowed.
+func validateName(name string) error {
+	if name == "" {
+		return fmt.Errorf("Invalid metric path, it can't be empty")
+	}
+	if r, found := findInvalid(name, isValidPathRune); found {
+		return fmt.Errorf("Invalid character %q in the metric path %q", r, name)
+	}
+	for _, node := range strings.Split(name, pathSeparator) {
+		if node == "" {
+			return fmt.Errorf("Invalid metric path %q, it can't contain empty nodes", name)
+		}
+	}
+	return nil
+}
+
+// sanitizeName applies the policy to the name of a series.
+func sanitizeName(name string, policy SanitizePolicy) (string, error) {
+	switch policy {
+	case SanitizeReplace:
+		return cleanName(name, replaceRune(isValidPathRune))
+	case SanitizeStrip:
+		return cleanName(name, stripRune(isValidPathRune))
+	case SanitizeReject:
+		return name, validateName(name)
+	}
+	return name, nil
+}
+
+// cleanName maps the characters of the name and removes its empty nodes.
+func cleanName(name string, mapping func(rune) rune) (string, error) {
+	nodes := []string{}
+	for _, node := range strings.Split(strings.Map(mapping, name), pathSeparator) {
+		if node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) == 0 {
+		return "", fmt.Errorf("Invalid metric path %q, nothing left after sanitizing it", name)
+	}
+	return strings.Join(nodes, pathSeparator), nil
+}
+
+// sanitizeTags applies the policy to the tags of a series. The characters not allowed are
+// replaced when formatting the series, so only stripping or rejecting them is needed here.
+func sanitizeTags(tags map[string]string, policy SanitizePolicy) (map[string]string, error) {
+	switch policy {
+	case SanitizeStrip:
+		stripped := map[string]string{}
+		for key, value := range tags {
+			value = strings.Map(stripRune(isValidTagValueRune), value)
+			stripped[strings.Map(stripRune(isValidTagKeyRune), key)] = strings.TrimLeft(value, "~")
+		}
+		return stripped, nil
+	case SanitizeReject:
+		for key, value := range tags {
+			if err := ValidateTag(key, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return tags, nil
+}
+
+// findInvalid returns the first character of the string not considered valid.
+func findInvalid(s string, valid func(rune) bool) (rune, bool) {
+	for _, r := range s {
+		if !valid(r) {
+			return r, true
+		}
+	}
+	return 0, false
+}
+
+func replaceRune(valid func(rune) bool) func(rune) rune {
+	return func(r rune) rune {
+		if !valid(r) {
+			return replacement
+		}
+		return r
+	}
+}
+
+func stripRune(valid func(rune) bool) func(rune) rune {
+	return func(r rune) rune {
+		if !valid(r) {
+			return -1
+		}
+		return r
+	}
+}
+
+// isValidPathRune returns whether the character is allowed in the name of a series: the printable
+// ASCII characters, excluding the whitespace and the tag separator.
+func isValidPathRune(r rune) bool {
+	return r > ' ' && r < unicode.MaxASCII && r != ';'
+}
+
+func isValidTagKeyRune(r rune) bool {
+	return isValidTagValueRune(r) && !strings.ContainsRune("!^=", r)
+}
+
+func isValidTagValueRune(r rune) bool {
+	return r != ';' && !isSpace(r) && !unicode.IsControl(r)
+}
@@ -0,0 +1,55 @@
+package graphite
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("path validation", func() {
+
+	It("accepts the valid paths", func() {
+		Expect(ValidatePath("cpu.usage-total:avg")).To(Succeed())
+	})
+
+	It("accepts the valid tagged series", func() {
+		Expect(ValidatePath("cpu.usage;host=web1;dc=eu-west")).To(Succeed())
+	})
+
+	It("rejects the empty paths", func() {
+		Expect(ValidatePath("")).To(MatchError(ContainSubstring("can't be empty")))
+	})
+
+	It("rejects the paths with empty nodes", func() {
+		Expect(ValidatePath("cpu..usage")).To(MatchError(ContainSubstring("empty nodes")))
+		Expect(ValidatePath(".cpu")).To(MatchError(ContainSubstring("empty nodes")))
+		Expect(ValidatePath("cpu.")).To(MatchError(ContainSubstring("empty nodes")))
+	})
+
+	It("rejects the paths with whitespaces, control or non-ASCII characters", func() {
+		Expect(ValidatePath("cpu usage")).To(HaveOccurred())
+		Expect(ValidatePath("cpu\nusage")).To(HaveOccurred())
+		Expect(ValidatePath("cpu\x00")).To(HaveOccurred())
+		Expect(ValidatePath("café")).To(MatchError(ContainSubstring("'é'")))
+	})
+
+	It("rejects the malformed tags", func() {
+		Expect(ValidatePath("cpu;host")).To(MatchError(ContainSubstring("key=value")))
+		Expect(ValidatePath("cpu;host=")).To(HaveOccurred())
+	})
+
+	It("rejects the tag keys with characters not allowed", func() {
+		for _, key := range []string{"ho!st", "ho^st", "ho=st", "ho st", "ho\tst"} {
+			Expect(ValidateTag(key, "web1")).To(HaveOccurred(), key)
+		}
+	})
+
+	It("rejects the tag values with characters not allowed", func() {
+		for _, value := range []string{"web 1", "web\n1", "~web1"} {
+			Expect(ValidateTag("host", value)).To(HaveOccurred(), value)
+		}
+	})
+
+	It("accepts the non-ASCII characters in the tags", func() {
+		Expect(ValidateTag("city", "málaga")).To(Succeed())
+	})
+})
@@ -0,0 +1,267 @@
+package graphite
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+const (
+	// DefaultSketchAccuracy specifies the default relative accuracy of the percentiles calculated
+	// by the sketch metrics: the values returned are within 1% of the real ones.
+	DefaultSketchAccuracy = 0.01
+	// DefaultSketchMaxBins specifies the default maximum number of bins stored by each sketch metric.
+	DefaultSketchMaxBins = 2048
+)
+
+// MetricSketch creates a metric to store the distribution of several values with a bounded
+// memory usage, using a DDSketch. Instead of keeping all the values, they are counted in bins
+// with logarithmic boundaries, so the percentiles calculated have a relative error of at most
+// its accuracy, regardless of the number of values received. Once the sketch reaches its maximum
+// number of bins the lowest ones are collapsed, so only the lowest percentiles lose accuracy.
+// It sends to graphite the following statistics: count, min, max, mean, median, p90 and p99.
+type MetricSketch struct {
+	// Accuracy is the relative accuracy of the percentiles, between 0 and 1. Defaults to
+	// DefaultSketchAccuracy.
+	Accuracy float64
+	// MaxBins is the maximum number of bins to store. Defaults to DefaultSketchMaxBins.
+	MaxBins int
+	// Precision is the number of decimals sent. Defaults to DefaultPrecision.
+	Precision int
+
+	positive map[int]int64
+	negative map[int]int64
+	zero     int64
+	count    int64
+	sum      float64
+	min      float64
+	max      float64
+}
+
+// NewMetricSketch returns a sketch metric with the accuracy and maximum number of bins received.
+func NewMetricSketch(accuracy float64, maxBins int) *MetricSketch {
+	return &MetricSketch{Accuracy: accuracy, MaxBins: maxBins}
+}
+
+// Update adds a new value, of any numeric type, to the distribution. If it receives another
+// sketch, it's merged.
+func (metric *MetricSketch) Update(value interface{}) error {
+	if sketch, ok := value.(*MetricSketch); ok {
+		return metric.Merge(sketch)
+	}
+	number, err := toFloat64(value)
+	if err != nil {
+		return err
+	}
+	metric.add(number, 1)
+	return nil
+}
+
+// Merge adds all the values of another sketch to this one, so the sketches filled by several
+// aggregators can be combined. If both sketches have different accuracy, the values of the other
+// sketch are added with the accuracy of this one.
+func (metric *MetricSketch) Merge(value Metric) error {
+	other, ok := value.(*MetricSketch)
+	if !ok {
+		return mergeError(metric, value)
+	}
+	if other == nil || other.count == 0 {
+		return nil
+	}
+	gamma, otherGamma := metric.getGamma(), other.getGamma()
+	for index, count := range other.positive {
+		metric.addBin(&metric.positive, metric.getIndex(other.getValue(index), gamma, otherGamma, index), count)
+	}
+	for index, count := range other.negative {
+		metric.addBin(&metric.negative, metric.getIndex(other.getValue(index), gamma, otherGamma, index), count)
+	}
+	metric.zero += other.zero
+	if metric.count == 0 || other.min < metric.min {
+		metric.min = other.min
+	}
+	if metric.count == 0 || other.max > metric.max {
+		metric.max = other.max
+	}
+	metric.count += other.count
+	metric.sum += other.sum
+	metric.collapse()
+	return nil
+}
+
+// clone returns a copy of the sketch, with the same configuration and values.
+func (metric *MetricSketch) clone() *MetricSketch {
+	sketch := &MetricSketch{Accuracy: metric.Accuracy, MaxBins: metric.MaxBins, Precision: metric.Precision}
+	sketch.Merge(metric)
+	return sketch
+}
+
+// Clear removes all the values of the distribution.
+func (metric *MetricSketch) Clear() {
+	metric.positive = nil
+	metric.negative = nil
+	metric.zero = 0
+	metric.count = 0
+	metric.sum = 0
+	metric.min = 0
+	metric.max = 0
+}
+
+// Calculate calculates the mean of the distribution, used when a single value is needed.
+func (metric *MetricSketch) Calculate() string {
+	if metric.count == 0 {
+		return "0"
+	}
+	return formatFloat(metric.sum/float64(metric.count), metric.Precision)
+}
+
+// CalculateAll calculates the statistics of the distribution to send, indexed by their suffix.
+// If there are no values only the count is sent.
+func (metric *MetricSketch) CalculateAll() map[string]string {
+	values := map[string]string{"count": strconv.FormatInt(metric.count, 10)}
+	if metric.count == 0 {
+		return values
+	}
+	values["min"] = formatFloat(metric.min, metric.Precision)
+	values["max"] = formatFloat(metric.max, metric.Precision)
+	values["mean"] = formatFloat(metric.sum/float64(metric.count), metric.Precision)
+	values["median"] = formatFloat(metric.Quantile(0.5), metric.Precision)
+	values["p90"] = formatFloat(metric.Quantile(0.9), metric.Precision)
+	values["p99"] = formatFloat(metric.Quantile(0.99), metric.Precision)
+	return values
+}
+
+// Count returns the number of values stored in the sketch.
+func (metric *MetricSketch) Count() int64 {
+	return metric.count
+}
+
+// Quantile returns the estimation of the quantile received, between 0 and 1.
+func (metric *MetricSketch) Quantile(q float64) float64 {
+	if metric.count == 0 {
+		return 0
+	}
+	rank := int64(q * float64(metric.count-1))
+	cumulative := int64(0)
+	value := metric.max
+	found := false
+	for _, index := range sortedIndexes(metric.negative, true) {
+		if cumulative += metric.negative[index]; cumulative > rank {
+			value, found = -metric.getValue(index), true
+			break
+		}
+	}
+	if !found {
+		if cumulative += metric.zero; cumulative > rank {
+			value, found = 0, true
+		}
+	}
+	if !found {
+		for _, index := range sortedIndexes(metric.positive, false) {
+			if cumulative += metric.positive[index]; cumulative > rank {
+				value = metric.getValue(index)
+				break
+			}
+		}
+	}
+	return math.Max(metric.min, math.Min(metric.max, value))
+}
+
+func (metric *MetricSketch) getAccuracy() float64 {
+	if metric.Accuracy > 0 && metric.Accuracy < 1 {
+		return metric.Accuracy
+	}
+	return DefaultSketchAccuracy
+}
+
+func (metric *MetricSketch) getMaxBins() int {
+	if metric.MaxBins > 0 {
+		return metric.MaxBins
+	}
+	return DefaultSketchMaxBins
+}
+
+func (metric *MetricSketch) getGamma() float64 {
+	accuracy := metric.getAccuracy()
+	return (1 + accuracy) / (1 - accuracy)
+}
+
+// getIndex returns the index of the bin, in this sketch, for the value of a bin of other sketch,
+// reusing its index if both of them have the same accuracy.
+func (metric *MetricSketch) getIndex(value float64, gamma float64, otherGamma float64, index int) int {
+	if gamma == otherGamma {
+		return index
+	}
+	return int(math.Ceil(math.Log(value) / math.Log(gamma)))
+}
+
+// getValue returns the value represented by a bin, which is within the accuracy of all the
+// values stored in it.
+func (metric *MetricSketch) getValue(index int) float64 {
+	gamma := metric.getGamma()
+	return 2 * math.Pow(gamma, float64(index)) / (gamma + 1)
+}
+
+func (metric *MetricSketch) add(value float64, count int64) {
+	gamma := metric.getGamma()
+	switch {
+	case value > 0:
+		metric.addBin(&metric.positive, int(math.Ceil(math.Log(value)/math.Log(gamma))), count)
+	case value < 0:
+		metric.addBin(&metric.negative, int(math.Ceil(math.Log(-value)/math.Log(gamma))), count)
+	default:
+		metric.zero += count
+	}
+	if metric.count == 0 || value < metric.min {
+		metric.min = value
+	}
+	if metric.count == 0 || value > metric.max {
+		metric.max = value
+	}
+	metric.count += count
+	metric.sum += value * float64(count)
+	metric.collapse()
+}
+
+func (metric *MetricSketch) addBin(bins *map[int]int64, index int, count int64) {
+	if *bins == nil {
+		*bins = map[int]int64{}
+	}
+	(*bins)[index] += count
+}
+
+// collapse merges the bins representing the lowest values while the sketch has more bins than
+// allowed, starting with the negative values with the highest magnitude.
+func (metric *MetricSketch) collapse() {
+	maxBins := metric.getMaxBins()
+	for len(metric.negative)+len(metric.positive) > maxBins {
+		if len(metric.negative) > 1 {
+			collapseBins(metric.negative, true)
+		} else if len(metric.positive) > 1 {
+			collapseBins(metric.positive, false)
+		} else {
+			return
+		}
+	}
+}
+
+// collapseBins merges the bin with the lowest value into the next one.
+func collapseBins(bins map[int]int64, negative bool) {
+	indexes := sortedIndexes(bins, negative)
+	bins[indexes[1]] += bins[indexes[0]]
+	delete(bins, indexes[0])
+}
+
+// sortedIndexes returns the indexes of the bins sorted from the lowest value they represent,
+// which for the negative values means from the highest index.
+func sortedIndexes(bins map[int]int64, negative bool) []int {
+	indexes := make([]int, 0, len(bins))
+	for index := range bins {
+		indexes = append(indexes, index)
+	}
+	if negative {
+		sort.Sort(sort.Reverse(sort.IntSlice(indexes)))
+	} else {
+		sort.Ints(indexes)
+	}
+	return indexes
+}
@@ -0,0 +1,144 @@
+package graphite
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("sketch metric", func() {
+
+	var (
+		metric *MetricSketch
+	)
+
+	BeforeEach(func() {
+		metric = NewMetricSketch(0.01, 0)
+	})
+
+	It("should implement MultiMetric interface", func() {
+		var _ MultiMetric = (*MetricSketch)(nil)
+	})
+
+	It("should initialise with count zero", func() {
+		Expect(metric.Calculate()).To(Equal("0"))
+		Expect(metric.CalculateAll()).To(Equal(map[string]string{"count": "0"}))
+	})
+
+	It("should calculate the exact count, min, max and mean", func() {
+		for i := 1; i <= 100; i++ {
+			metric.Update(i)
+		}
+		values := metric.CalculateAll()
+		Expect(values["count"]).To(Equal("100"))
+		Expect(values["min"]).To(Equal("1.000000"))
+		Expect(values["max"]).To(Equal("100.000000"))
+		Expect(values["mean"]).To(Equal("50.500000"))
+	})
+
+	It("should calculate the percentiles within its relative accuracy", func() {
+		values := []float64{}
+		for i := 0; i < 100000; i++ {
+			value := rand.ExpFloat64() * 100
+			values = append(values, value)
+			metric.Update(value)
+		}
+		sort.Float64s(values)
+		for _, q := range []float64{0.5, 0.9, 0.99} {
+			exact := values[int(q*float64(len(values)-1))]
+			Expect(math.Abs(metric.Quantile(q)-exact) / exact).To(BeNumerically("<=", 0.02))
+		}
+	})
+
+	It("should use a bounded number of bins", func() {
+		metric = NewMetricSketch(0.01, 64)
+		for i := 1; i <= 100000; i++ {
+			metric.Update(float64(i))
+		}
+		Expect(len(metric.positive)).To(BeNumerically("<=", 64))
+		Expect(metric.Count()).To(Equal(int64(100000)))
+		Expect(math.Abs(metric.Quantile(0.99)-99000) / 99000).To(BeNumerically("<=", 0.01))
+	})
+
+	It("should handle zero and negative values", func() {
+		for _, value := range []float64{-10, -5, 0, 5, 10} {
+			metric.Update(value)
+		}
+		Expect(metric.Quantile(0)).To(Equal(-10.0))
+		Expect(metric.Quantile(0.25)).To(BeNumerically("~", -5, 0.05))
+		Expect(metric.Quantile(0.5)).To(Equal(0.0))
+		Expect(metric.Quantile(1)).To(Equal(10.0))
+	})
+
+	It("should merge other sketches", func() {
+		other := NewMetricSketch(0.01, 0)
+		for i := 1; i <= 50; i++ {
+			metric.Update(i)
+			other.Update(i + 50)
+		}
+		metric.Update(other)
+		Expect(metric.Count()).To(Equal(int64(100)))
+		Expect(metric.CalculateAll()["max"]).To(Equal("100.000000"))
+		Expect(math.Abs(metric.Quantile(0.9)-90) / 90).To(BeNumerically("<=", 0.01))
+	})
+
+	It("should merge sketches with a different accuracy", func() {
+		other := NewMetricSketch(0.05, 0)
+		for i := 1; i <= 100; i++ {
+			other.Update(i)
+		}
+		metric.Merge(other)
+		Expect(metric.Count()).To(Equal(int64(100)))
+		Expect(math.Abs(metric.Quantile(0.5)-50) / 50).To(BeNumerically("<=", 0.06))
+	})
+
+	It("should clear the internal values", func() {
+		metric.Update(5)
+		metric.Clear()
+		Expect(metric.CalculateAll()).To(Equal(map[string]string{"count": "0"}))
+	})
+
+	Context("used by the aggregator", func() {
+
+		It("creates the sketches with the accuracy of the configuration", func() {
+			agg := newAggregator(&Config{SketchAccuracy: 0.02, SketchMaxBins: 100}, &MockGraphite{}).(*aggregator)
+			agg.ObserveSketch("metric", 5)
+			sketch := agg.GetMetrics()["metric"].(*MetricSketch)
+			Expect(sketch.Accuracy).To(Equal(0.02))
+			Expect(sketch.MaxBins).To(Equal(100))
+		})
+
+		It("merges the sketches received", func() {
+			agg := newAggregator(&Config{}, &MockGraphite{}).(*aggregator)
+			other := NewMetricSketch(0, 0)
+			other.Update(10)
+			other.Update(20)
+			agg.ObserveSketchTagged("metric", map[string]string{"host": "web1"}, 30)
+			agg.MergeSketchTagged("metric", map[string]string{"host": "web1"}, other)
+			Expect(agg.GetMetrics()["metric;host=web1"].(*MetricSketch).CalculateAll()["count"]).To(Equal("3"))
+		})
+
+		It("returns a copy of the sketches to merge them into other aggregators", func() {
+			worker := newAggregator(&Config{}, &MockGraphite{})
+			global := newAggregator(&Config{}, &MockGraphite{}).(*aggregator)
+			worker.ObserveSketch("metric", 10)
+			worker.ObserveSketch("metric", 20)
+			sketch := worker.Sketch("metric")
+			Expect(sketch.Count()).To(Equal(int64(2)))
+			sketch.Update(30)
+			Expect(worker.Sketch("metric").Count()).To(Equal(int64(2)))
+			global.MergeSketch("metric", sketch)
+			Expect(global.GetMetrics()["metric"].(*MetricSketch).Count()).To(Equal(int64(3)))
+		})
+
+		It("returns nil if there is no sketch for the path", func() {
+			agg := newAggregator(&Config{}, &MockGraphite{})
+			agg.AddSum("metric", 5)
+			Expect(agg.Sketch("metric")).To(BeNil())
+			Expect(agg.SketchTagged("other", map[string]string{"host": "web1"})).To(BeNil())
+		})
+	})
+})
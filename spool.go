@@ -0,0 +1,177 @@
+package graphite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultSpoolMaxSize specifies the default maximum size in bytes of the spool directory.
+	DefaultSpoolMaxSize = 100 * 1024 * 1024
+	// DefaultSpoolSegmentSize specifies the default maximum size in bytes of each spool segment.
+	DefaultSpoolSegmentSize = 1024 * 1024
+	// spoolExtension is the extension used by the segment files.
+	spoolExtension = ".spool"
+)
+
+// spool is a write-ahead log on disk, split in segment files, where the metrics that couldn't
+// be sent are persisted until they can be replayed in the same order.
+type spool struct {
+	dir         string
+	maxSize     int64
+	segmentSize int64
+	mutex       *sync.Mutex
+}
+
+// spoolLocks stores the mutex of each spool directory, shared by all the aggregators using it,
+// so one of them can't remove a segment while another one is appending metrics to it.
+var spoolLocks = struct {
+	sync.Mutex
+	dirs map[string]*sync.Mutex
+}{dirs: map[string]*sync.Mutex{}}
+
+func newSpool(config *Config) *spool {
+	if config.SpoolDir == "" {
+		return nil
+	}
+	return &spool{
+		dir:         config.SpoolDir,
+		maxSize:     config.getSpoolMaxSize(),
+		segmentSize: config.getSpoolSegmentSize(),
+		mutex:       getSpoolLock(config.SpoolDir),
+	}
+}
+
+// getSpoolLock returns the mutex of the spool directory, identified by its absolute path.
+func getSpoolLock(dir string) *sync.Mutex {
+	if absolute, err := filepath.Abs(dir); err == nil {
+		dir = absolute
+	}
+	spoolLocks.Lock()
+	defer spoolLocks.Unlock()
+	if _, exists := spoolLocks.dirs[dir]; !exists {
+		spoolLocks.dirs[dir] = &sync.Mutex{}
+	}
+	return spoolLocks.dirs[dir]
+}
+
+// segments returns the sequence numbers of the segments stored in the spool, from the oldest one.
+func (spool *spool) segments() ([]int64, error) {
+	files, err := ioutil.ReadDir(spool.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	segments := []int64{}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, spoolExtension) {
+			continue
+		}
+		if sequence, err := strconv.ParseInt(strings.TrimSuffix(name, spoolExtension), 10, 64); err == nil {
+			segments = append(segments, sequence)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func (spool *spool) getPath(sequence int64) string {
+	return filepath.Join(spool.dir, fmt.Sprintf("%020d%s", sequence, spoolExtension))
+}
+
+func (spool *spool) getSize(sequence int64) int64 {
+	if info, err := os.Stat(spool.getPath(sequence)); err == nil {
+		return info.Size()
+	}
+	return 0
+}
+
+// write appends the metrics to the latest segment, creating a new one if it would exceed the
+// segment size, and discards the oldest segments if the spool exceeds its maximum size.
+func (spool *spool) write(data []byte) error {
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+	if err := os.MkdirAll(spool.dir, 0755); err != nil {
+		return fmt.Errorf("Unable to create the spool directory: %s", err.Error())
+	}
+	segments, err := spool.segments()
+	if err != nil {
+		return fmt.Errorf("Unable to read the spool directory: %s", err.Error())
+	}
+	sequence := int64(0)
+	if len(segments) > 0 {
+		sequence = segments[len(segments)-1]
+		if spool.getSize(sequence)+int64(len(data)) > spool.segmentSize {
+			sequence++
+			segments = append(segments, sequence)
+		}
+	} else {
+		segments = append(segments, sequence)
+	}
+	file, err := os.OpenFile(spool.getPath(sequence), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to open the spool segment: %s", err.Error())
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("Unable to write the spool segment: %s", err.Error())
+	}
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("Unable to write the spool segment: %s", err.Error())
+	}
+	spool.trim(segments)
+	return nil
+}
+
+// trim removes the oldest segments until the spool fits in its maximum size, always
+// keeping the latest segment.
+func (spool *spool) trim(segments []int64) {
+	total := int64(0)
+	for _, sequence := range segments {
+		total += spool.getSize(sequence)
+	}
+	for i := 0; i < len(segments)-1 && total > spool.maxSize; i++ {
+		total -= spool.getSize(segments[i])
+		os.Remove(spool.getPath(segments[i]))
+	}
+}
+
+// replay sends the segments stored in the spool, in order, removing each one of them once sent.
+// It stops with the first segment that can't be sent, keeping it and the following ones.
+func (spool *spool) replay(ctx context.Context, client Graphite) (int, error) {
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+	segments, err := spool.segments()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to read the spool directory: %s", err.Error())
+	}
+	total := 0
+	for _, sequence := range segments {
+		data, err := ioutil.ReadFile(spool.getPath(sequence))
+		if err != nil {
+			return total, fmt.Errorf("Unable to read the spool segment: %s", err.Error())
+		}
+		if len(data) > 0 {
+			n, err := client.SendBufferContext(ctx, bytes.NewBuffer(data))
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+		if err := os.Remove(spool.getPath(sequence)); err != nil {
+			return total, fmt.Errorf("Unable to remove the spool segment: %s", err.Error())
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,211 @@
+package graphite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("disk spool", func() {
+
+	var (
+		dir       string
+		client    *MockGraphite
+		sent      []string
+		attempted []string
+		fail      bool
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "graphite-spool")
+		Expect(err).ToNot(HaveOccurred())
+		sent = []string{}
+		attempted = []string{}
+		fail = false
+		client = &MockGraphite{
+			Data: map[string]string{},
+			MethodSendBuffer: func(m *MockGraphite, buffer *bytes.Buffer) (int, error) {
+				attempted = append(attempted, buffer.String())
+				if fail {
+					return 0, errors.New("Unable to send metrics to graphite")
+				}
+				sent = append(sent, buffer.String())
+				return buffer.Len(), nil
+			},
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("is not created if no directory is configured", func() {
+		Expect(newSpool(&Config{})).To(BeNil())
+	})
+
+	It("replays the metrics in the same order they were written", func() {
+		spool := newSpool(&Config{SpoolDir: dir})
+		Expect(spool.write([]byte("a 1 1554992147\n"))).To(Succeed())
+		Expect(spool.write([]byte("b 2 1554992148\n"))).To(Succeed())
+		n, err := spool.replay(context.Background(), client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(30))
+		Expect(sent).To(Equal([]string{"a 1 1554992147\nb 2 1554992148\n"}))
+	})
+
+	It("removes the segments once replayed", func() {
+		spool := newSpool(&Config{SpoolDir: dir})
+		spool.write([]byte("a 1 1554992147\n"))
+		spool.replay(context.Background(), client)
+		segments, _ := spool.segments()
+		Expect(segments).To(BeEmpty())
+		n, err := spool.replay(context.Background(), client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(0))
+	})
+
+	It("rotates the segments when they exceed the segment size", func() {
+		spool := newSpool(&Config{SpoolDir: dir, SpoolSegmentSize: 20})
+		spool.write([]byte("a 1 1554992147\n"))
+		spool.write([]byte("b 2 1554992148\n"))
+		segments, _ := spool.segments()
+		Expect(segments).To(Equal([]int64{0, 1}))
+		spool.replay(context.Background(), client)
+		Expect(sent).To(Equal([]string{"a 1 1554992147\n", "b 2 1554992148\n"}))
+	})
+
+	It("discards the oldest segments when exceeding the maximum size", func() {
+		spool := newSpool(&Config{SpoolDir: dir, SpoolSegmentSize: 20, SpoolMaxSize: 40})
+		spool.write([]byte("a 1 1554992147\n"))
+		spool.write([]byte("b 2 1554992148\n"))
+		spool.write([]byte("c 3 1554992149\n"))
+		segments, _ := spool.segments()
+		Expect(segments).To(Equal([]int64{1, 2}))
+	})
+
+	It("keeps the segments that couldn't be replayed", func() {
+		spool := newSpool(&Config{SpoolDir: dir, SpoolSegmentSize: 20})
+		spool.write([]byte("a 1 1554992147\n"))
+		spool.write([]byte("b 2 1554992148\n"))
+		fail = true
+		_, err := spool.replay(context.Background(), client)
+		Expect(err).To(HaveOccurred())
+		segments, _ := spool.segments()
+		Expect(segments).To(Equal([]int64{0, 1}))
+	})
+
+	It("shares the lock between the spools of the same directory", func() {
+		spool := newSpool(&Config{SpoolDir: dir})
+		Expect(newSpool(&Config{SpoolDir: dir + "/"}).mutex).To(BeIdenticalTo(spool.mutex))
+		Expect(newSpool(&Config{SpoolDir: dir + "-other"}).mutex).ToNot(BeIdenticalTo(spool.mutex))
+	})
+
+	It("doesn't lose the metrics written by another spool of the same directory while replaying", func() {
+		spool := newSpool(&Config{SpoolDir: dir})
+		other := newSpool(&Config{SpoolDir: dir})
+		spool.write([]byte("a 1 1554992147\n"))
+		written := make(chan error)
+		client.MethodSendBuffer = func(m *MockGraphite, buffer *bytes.Buffer) (int, error) {
+			go func() {
+				written <- other.write([]byte("b 2 1554992148\n"))
+			}()
+			time.Sleep(50 * time.Millisecond)
+			sent = append(sent, buffer.String())
+			return buffer.Len(), nil
+		}
+		_, err := spool.replay(context.Background(), client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(<-written).To(Succeed())
+		Expect(sent).To(Equal([]string{"a 1 1554992147\n"}))
+		data, _ := ioutil.ReadFile(spool.getPath(0))
+		Expect(string(data)).To(Equal("b 2 1554992148\n"))
+	})
+
+	Context("used by the aggregator", func() {
+
+		var (
+			agg *aggregator
+		)
+
+		BeforeEach(func() {
+			agg = newAggregator(&Config{SpoolDir: dir}, client).(*aggregator)
+		})
+
+		It("persists the metrics if they can't be sent after retrying", func() {
+			fail = true
+			agg.AddSum("metric", 5)
+			agg.tick()
+			Expect(agg.GetMetrics()).To(BeEmpty())
+			segments, _ := agg.spool.segments()
+			Expect(segments).To(HaveLen(1))
+		})
+
+		It("persists exactly the metrics that couldn't be sent", func() {
+			fail = true
+			agg.AddSum("metric", 5)
+			agg.tick()
+			data, _ := ioutil.ReadFile(agg.spool.getPath(0))
+			Expect(attempted).To(HaveLen(2))
+			Expect(attempted[0]).To(Equal(string(data)))
+			Expect(attempted[1]).To(Equal(string(data)))
+		})
+
+		It("persists the metrics if they can't be sent after calling Retry", func() {
+			fail = true
+			agg.AddSum("metric", 5)
+			_, err := agg.Flush()
+			Expect(err).To(HaveOccurred())
+			_, err = agg.Retry()
+			Expect(err).To(HaveOccurred())
+			Expect(agg.GetMetrics()).To(BeEmpty())
+			data, _ := ioutil.ReadFile(agg.spool.getPath(0))
+			Expect(string(data)).To(Equal(attempted[1]))
+		})
+
+		It("persists the metrics if the reconnect policy doesn't allow to retry", func() {
+			client.MethodReconnect = func(m *MockGraphite) error {
+				return &CircuitOpenError{}
+			}
+			agg.AddSum("metric", 5)
+			_, err := agg.Retry()
+			Expect(err).To(BeAssignableToTypeOf(&CircuitOpenError{}))
+			Expect(attempted).To(BeEmpty())
+			Expect(agg.GetMetrics()).To(BeEmpty())
+			data, _ := ioutil.ReadFile(agg.spool.getPath(0))
+			Expect(string(data)).To(MatchRegexp(`^metric 5 \d{10}\n$`))
+		})
+
+		It("replays the persisted metrics with their original timestamp before the new ones", func() {
+			fail = true
+			agg.AddSum("metric", 5)
+			agg.tick()
+			data, _ := ioutil.ReadFile(agg.spool.getPath(0))
+			fail = false
+			agg.AddSum("metric", 10)
+			agg.tick()
+			Expect(sent).To(HaveLen(2))
+			Expect(sent[0]).To(Equal(string(data)))
+			Expect(sent[0]).To(MatchRegexp(`^metric 5 \d{10}\n$`))
+			Expect(sent[1]).To(MatchRegexp(`^metric 10 \d{10}\n$`))
+		})
+
+		It("keeps the metrics without sending them if the spool can't be replayed", func() {
+			fail = true
+			agg.AddSum("metric", 5)
+			agg.tick()
+			agg.AddSum("metric", 10)
+			_, err := agg.Flush()
+			Expect(err).To(HaveOccurred())
+			Expect(attempted).To(HaveLen(3))
+			Expect(attempted[2]).To(MatchRegexp(`^metric 5 \d{10}\n$`))
+			Expect(agg.GetMetrics()["metric"].Calculate()).To(Equal("10"))
+		})
+	})
+})
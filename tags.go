@@ -0,0 +1,77 @@
+package graphite
+
+import (
+	"sort"
+	"strings"
+)
+
+// tagSeparator separates the name and the tags of a tagged series.
+const tagSeparator = ";"
+
+// parseSeries splits a path in the format name;tag1=value1;tag2=value2 into its name and its tags.
+func parseSeries(path string) (string, map[string]string) {
+	parts := strings.Split(path, tagSeparator)
+	tags := map[string]string{}
+	for _, part := range parts[1:] {
+		if pair := strings.SplitN(part, "=", 2); len(pair) == 2 {
+			tags[pair[0]] = pair[1]
+		}
+	}
+	return parts[0], tags
+}
+
+// formatSeries returns the canonical representation of a tagged series, as specified by graphite:
+// the name followed by the tags sorted by key, name;tag1=value1;tag2=value2. The characters not
+// allowed in the tags are replaced, and the tags without key or value are discarded.
+func formatSeries(name string, tags map[string]string) string {
+	keys := []string{}
+	escaped := map[string]string{}
+	for key, value := range tags {
+		key, value = escapeTagKey(key), escapeTagValue(value)
+		if key == "" || value == "" || key == "name" {
+			continue
+		}
+		if _, exists := escaped[key]; !exists {
+			keys = append(keys, key)
+		}
+		escaped[key] = value
+	}
+	sort.Strings(keys)
+	series := name
+	for _, key := range keys {
+		series += tagSeparator + key + "=" + escaped[key]
+	}
+	return series
+}
+
+// mergeTags returns a new map with the tags of all the maps received, where the latest ones
+// take precedence over the previous ones.
+func mergeTags(tags ...map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, current := range tags {
+		for key, value := range current {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// escapeTagKey replaces the characters not allowed in a tag key: ;!^=, whitespaces and
+// control characters.
+func escapeTagKey(key string) string {
+	return strings.Map(replaceRune(isValidTagKeyRune), key)
+}
+
+// escapeTagValue replaces the characters not allowed in a tag value: ;, whitespaces and control
+// characters, plus the ~ character when used as the first character.
+func escapeTagValue(value string) string {
+	escaped := strings.Map(replaceRune(isValidTagValueRune), value)
+	if strings.HasPrefix(escaped, "~") {
+		escaped = string(replacement) + escaped[1:]
+	}
+	return escaped
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\v' || r == '\f'
+}
@@ -0,0 +1,44 @@
+package graphite
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("tagged series", func() {
+
+	It("sorts the tags by key after the name", func() {
+		series := formatSeries("cpu.usage", map[string]string{"host": "web1", "dc": "eu", "az": "b"})
+		Expect(series).To(Equal("cpu.usage;az=b;dc=eu;host=web1"))
+	})
+
+	It("returns the name if there are no tags", func() {
+		Expect(formatSeries("cpu.usage", nil)).To(Equal("cpu.usage"))
+	})
+
+	It("replaces the characters not allowed in the tag keys", func() {
+		series := formatSeries("cpu", map[string]string{"a;b!c^d=e f": "value"})
+		Expect(series).To(Equal("cpu;a_b_c_d_e_f=value"))
+	})
+
+	It("replaces the characters not allowed in the tag values", func() {
+		series := formatSeries("cpu", map[string]string{"host": "~web;1 eu=a"})
+		Expect(series).To(Equal("cpu;host=_web_1_eu=a"))
+	})
+
+	It("discards the tags without key or value and the reserved name tag", func() {
+		series := formatSeries("cpu", map[string]string{"": "value", "host": "", "name": "other", "dc": "eu"})
+		Expect(series).To(Equal("cpu;dc=eu"))
+	})
+
+	It("parses the name and the tags of a series", func() {
+		name, tags := parseSeries("cpu.usage;host=web1;dc=eu")
+		Expect(name).To(Equal("cpu.usage"))
+		Expect(tags).To(Equal(map[string]string{"host": "web1", "dc": "eu"}))
+	})
+
+	It("merges the tags giving precedence to the latest ones", func() {
+		merged := mergeTags(map[string]string{"dc": "eu", "host": "web1"}, nil, map[string]string{"host": "web2"})
+		Expect(merged).To(Equal(map[string]string{"dc": "eu", "host": "web2"}))
+	})
+})